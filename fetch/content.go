@@ -0,0 +1,154 @@
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+)
+
+/*
+DefaultMaxBodySize is how much of a page we'll read looking for links if not
+told otherwise. Anything past it is ignored.
+*/
+const DefaultMaxBodySize int64 = 10 << 20
+
+/*
+sniffLen is how much of a body http.DetectContentType looks at.
+*/
+const sniffLen = 512
+
+/*
+prescanLen is how much of a page we look through for a BOM or <meta charset>
+before deciding what it's encoded in, which is what browsers do too.
+*/
+const prescanLen = 1024
+
+/*
+nonHTMLExtensions are file extensions that almost never turn out to be HTML,
+so URLs ending in them get a HEAD request first to check before we download
+them.
+*/
+var nonHTMLExtensions = map[string]bool{
+	".7z": true, ".avi": true, ".bz2": true, ".css": true, ".csv": true,
+	".dmg": true, ".doc": true, ".docx": true, ".exe": true, ".gif": true,
+	".gz": true, ".ico": true, ".iso": true, ".jpeg": true, ".jpg": true,
+	".js": true, ".json": true, ".mov": true, ".mp3": true, ".mp4": true,
+	".pdf": true, ".png": true, ".ppt": true, ".pptx": true, ".rar": true,
+	".svg": true, ".tar": true, ".tgz": true, ".ttf": true, ".txt": true,
+	".wav": true, ".webm": true, ".webp": true, ".woff": true, ".woff2": true,
+	".xls": true, ".xlsx": true, ".xml": true, ".zip": true,
+}
+
+/*
+looksNonHTML returns whether link's extension suggests it isn't a web page.
+*/
+func looksNonHTML(link *url.URL) bool {
+	return nonHTMLExtensions[strings.ToLower(path.Ext(link.Path))]
+}
+
+/*
+isHTML returns whether a Content-Type is a web page we should look for links
+in.
+*/
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+/*
+needsSniffing returns whether a Content-Type tells us so little that it's
+worth looking at the body to work it out.
+*/
+func needsSniffing(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err != nil || mediaType == "application/octet-stream"
+}
+
+/*
+sniff works out the content type from the start of body, like a browser
+would. It returns a reader that still starts at the beginning of the body.
+*/
+func sniff(body io.Reader) (string, io.Reader) {
+	buffered := bufio.NewReaderSize(body, sniffLen)
+	start, _ := buffered.Peek(sniffLen)
+	return http.DetectContentType(start), buffered
+}
+
+/*
+decode works out what character set body is in, from its BOM, the charset in
+contentType, or a <meta charset> near the start of it (in that order), and
+returns a reader that turns it into UTF-8, along with the name of the charset.
+If it can't tell, it goes with windows-1252, like browsers do.
+*/
+func decode(body io.Reader, contentType string) (io.Reader, string) {
+	buffered := bufio.NewReaderSize(body, prescanLen)
+	start, _ := buffered.Peek(prescanLen)
+	encoding, name, _ := charset.DetermineEncoding(start, contentType)
+	if name == "utf-8" {
+		return buffered, name
+	}
+	return transform.NewReader(buffered, encoding.NewDecoder()), name
+}
+
+/*
+lastModified returns the time in a Last-Modified header, or the zero time if
+there isn't one or it doesn't parse.
+*/
+func lastModified(header http.Header) time.Time {
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}
+	}
+	return modified
+}
+
+/*
+probe makes a HEAD request for link, following redirects, to find out what it
+is without downloading it. It returns settled true if that's all there is to
+know: it isn't HTML, or the redirects led nowhere we can go. Otherwise, if
+it's HTML, or the server wouldn't give us a straight answer, it's worth trying
+a GET instead. Every request it makes goes through slot, like followRedirects.
+*/
+func probe(ctx context.Context, client *http.Client, link *url.URL, opts Options, slot *hostSlot) (JobResult, bool) {
+	result := JobResult{FromURL: link}
+	resp, redirects, elapsed, err := followRedirects(ctx, client, http.MethodHead, link, opts, slot)
+	if errors.Is(err, errRedirectNotFollowed) || errors.Is(err, ErrRedirectLoop) || errors.Is(err, ErrTooManyRedirects) {
+		// A GET would only go the same way.
+		return unfinished(link, redirects, elapsed, err, opts), true
+	}
+	if err != nil {
+		return result, false
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// Plenty of servers get HEAD wrong, so don't believe an error.
+		return result, false
+	}
+	result.ContentType = resp.Header.Get("Content-Type")
+	if result.ContentType == "" || isHTML(result.ContentType) {
+		// Either it's a page after all, or the body will have to tell us.
+		return result, false
+	}
+	result.StatusCode = resp.StatusCode
+	result.FinalURL = resp.Request.URL
+	result.Redirects = redirects
+	result.LastModified = lastModified(resp.Header)
+	result.ResponseTime = elapsed
+	if resp.ContentLength > 0 {
+		result.ContentLength = resp.ContentLength
+	}
+	return result, true
+}
@@ -0,0 +1,243 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestIsHTML(t *testing.T) {
+	cases := map[string]bool{
+		"text/html":                 true,
+		"text/html; charset=utf-8":  true,
+		"application/xhtml+xml":     true,
+		"TEXT/HTML":                 true,
+		"application/pdf":           false,
+		"text/plain; charset=utf-8": false,
+		"":                          false,
+	}
+	for contentType, expected := range cases {
+		if actual := isHTML(contentType); actual != expected {
+			t.Errorf("Expected isHTML(%q) to be %t", contentType, expected)
+		}
+	}
+}
+
+func TestLooksNonHTML(t *testing.T) {
+	cases := map[string]bool{
+		"https://kn100.me/cv.PDF":         true,
+		"https://kn100.me/files/site.zip": true,
+		"https://kn100.me/about":          false,
+		"https://kn100.me/about.html":     false,
+		"https://kn100.me/":               false,
+	}
+	for link, expected := range cases {
+		u, _ := url.Parse(link)
+		if actual := looksNonHTML(u); actual != expected {
+			t.Errorf("Expected looksNonHTML(%s) to be %t", link, expected)
+		}
+	}
+}
+
+/*
+fileServer serves a few things that aren't pages, and counts the requests
+made for each path by method.
+*/
+func fileServer(requests map[string]int, mu *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/cv.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Length", "123456")
+			w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+			if r.Method == http.MethodGet {
+				w.Write(make([]byte, 123456))
+			}
+		case "/no-head.txt":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="/found">Found</a>`)
+		case "/untyped.txt":
+			// Nil stops the server filling one in for us.
+			w.Header()["Content-Type"] = nil
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, `<html><a href="/found">Found</a></html>`)
+			}
+		case "/loop.pdf":
+			http.Redirect(w, r, "/loop.pdf", http.StatusFound)
+		case "/moved.pdf":
+			http.Redirect(w, r, "/cv.pdf", http.StatusMovedPermanently)
+		case "/unlabelled-page":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			fmt.Fprint(w, `<html><a href="/found">Found</a></html>`)
+		case "/unlabelled-image":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("\x89PNG\x0D\x0A\x1A\x0A<a href=\"/not-a-link\">"))
+		}
+	}))
+}
+
+func TestLinksProbesFilesWithHead(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := fileServer(requests, &mu)
+	defer ts.Close()
+
+	pdf, _ := url.Parse(ts.URL + "/cv.pdf")
+	r := Links(context.Background(), ts.Client(), []*url.URL{pdf}, DefaultOptions())[0]
+	if requests["GET /cv.pdf"] != 0 || requests["HEAD /cv.pdf"] != 1 {
+		t.Errorf("Expected only a HEAD request for the PDF, got %v", requests)
+	}
+	if r.StatusCode != 200 || r.ContentType != "application/pdf" || r.ContentLength != 123456 {
+		t.Errorf("Expected the PDF's type and size to be recorded, got %d %s %d", r.StatusCode, r.ContentType, r.ContentLength)
+	}
+	if r.BytesRead != 0 {
+		t.Errorf("Expected nothing to be downloaded for a HEAD request, got %d bytes", r.BytesRead)
+	}
+	if !r.LastModified.Equal(time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)) {
+		t.Errorf("Expected the PDF's Last-Modified to be recorded, got %s", r.LastModified)
+	}
+
+	noHead, _ := url.Parse(ts.URL + "/no-head.txt")
+	r = Links(context.Background(), ts.Client(), []*url.URL{noHead}, DefaultOptions())[0]
+	if len(r.LinksTo) != 1 {
+		t.Errorf("Expected a GET after HEAD failed, and its link to be found, got %v", r.LinksTo)
+	}
+}
+
+func TestLinksProbeFallsBackOnlyWhenUnsure(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := fileServer(requests, &mu)
+	defer ts.Close()
+
+	untyped, _ := url.Parse(ts.URL + "/untyped.txt")
+	r := Links(context.Background(), ts.Client(), []*url.URL{untyped}, DefaultOptions())[0]
+	if requests["GET /untyped.txt"] != 1 || len(r.LinksTo) != 1 {
+		t.Errorf("Expected a GET when HEAD had no Content-Type, and its link to be found, got %v and %v", requests, r.LinksTo)
+	}
+
+	loop, _ := url.Parse(ts.URL + "/loop.pdf")
+	r = Links(context.Background(), ts.Client(), []*url.URL{loop}, DefaultOptions())[0]
+	if requests["GET /loop.pdf"] != 0 || !errors.Is(r.Err, ErrRedirectLoop) {
+		t.Errorf("Expected a HEAD redirect loop to be reported without a GET, got %v and %v", requests, r.Err)
+	}
+
+	moved, _ := url.Parse(ts.URL + "/moved.pdf")
+	opts := DefaultOptions()
+	opts.FollowRedirect = func(link *url.URL) bool { return false }
+	r = Links(context.Background(), ts.Client(), []*url.URL{moved}, opts)[0]
+	if requests["GET /moved.pdf"] != 0 || requests["HEAD /cv.pdf"] != 0 {
+		t.Errorf("Expected a redirect we may not follow to stop at the HEAD, got %v", requests)
+	}
+	if r.Err != nil || r.StatusCode != http.StatusMovedPermanently || len(r.Redirects) != 1 {
+		t.Errorf("Expected to stop at the redirect, got %d %v %v", r.StatusCode, r.Redirects, r.Err)
+	}
+}
+
+func TestLinksSniffsContentType(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := fileServer(requests, &mu)
+	defer ts.Close()
+
+	page, _ := url.Parse(ts.URL + "/unlabelled-page")
+	image, _ := url.Parse(ts.URL + "/unlabelled-image")
+	results := Links(context.Background(), ts.Client(), []*url.URL{page, image}, Options{Concurrency: 1})
+	for _, r := range results {
+		if r.FromURL == page && len(r.LinksTo) != 1 {
+			t.Errorf("Expected the unlabelled page to be sniffed as HTML, got %v", r.LinksTo)
+		}
+		if r.FromURL == image && len(r.LinksTo) != 0 {
+			t.Errorf("Expected the unlabelled image not to be read for links, got %v", r.LinksTo)
+		}
+	}
+
+	// Without sniffing, we believe the server.
+	results = Links(context.Background(), ts.Client(), []*url.URL{page}, Options{NoSniff: true})
+	if len(results[0].LinksTo) != 0 {
+		t.Errorf("Expected an octet-stream not to be read for links, got %v", results[0].LinksTo)
+	}
+}
+
+func TestLinksCapsBodySize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<a href="/near">Near</a>`+strings.Repeat(" ", 1000)+`<a href="/far">Far</a>`)
+	}))
+	defer ts.Close()
+
+	opts := DefaultOptions()
+	opts.MaxBodySize = 500
+	r := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), opts)[0]
+	if len(r.LinksTo) != 1 || r.LinksTo[0].URL.Path != "/near" {
+		t.Errorf("Expected only the link before the cap to be found, got %v", r.LinksTo)
+	}
+	if !r.Truncated || r.ContentLength != 500 {
+		t.Errorf("Expected the page to be marked as truncated at 500 bytes, got %d (truncated %t)", r.ContentLength, r.Truncated)
+	}
+	if r.BytesRead <= 500 {
+		t.Errorf("Expected reading past the cap to be counted, got %d bytes read", r.BytesRead)
+	}
+
+	opts.MaxBodySize = 10000
+	r = Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), opts)[0]
+	if len(r.LinksTo) != 2 || r.Truncated {
+		t.Errorf("Expected the whole page to be read, got %v (truncated %t)", r.LinksTo, r.Truncated)
+	}
+}
+
+func TestLinksDecodesCharsets(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		encoding    encoding.Encoding
+		page        string
+		path        string
+	}{
+		{"shift_jis", "text/html; charset=Shift_JIS", japanese.ShiftJIS, `<a href="/日本語">日本語</a>`, "/日本語"},
+		{"windows-1252", "text/html", charmap.Windows1252, `<meta charset="windows-1252"><a href="/café">Café</a>`, "/café"},
+		// ISO-8859-1 is treated as windows-1252, like browsers do.
+		{"windows-1252", "text/html", charmap.ISO8859_1, `<meta http-equiv="Content-Type" content="text/html; charset=iso-8859-1"><a href="/über">Über</a>`, "/über"},
+		{"iso-8859-7", "text/html; charset=iso-8859-7", charmap.ISO8859_7, `<a href="/αβγ">αβγ</a>`, "/αβγ"},
+		{"utf-16le", "text/html", unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), `<a href="/ünï">Ünï</a>`, "/ünï"},
+		{"utf-8", "text/html; charset=utf-8", encoding.Nop, `<a href="/ok">Ok</a>`, "/ok"},
+	}
+	for _, c := range cases {
+		body, err := c.encoding.NewEncoder().String(c.page)
+		if err != nil {
+			t.Fatalf("Couldn't encode the %s test page. Err: %s", c.name, err)
+		}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", c.contentType)
+			fmt.Fprint(w, body)
+		}))
+
+		r := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), DefaultOptions())[0]
+		if r.Charset != c.name {
+			t.Errorf("Expected the page to be detected as %s, got %s", c.name, r.Charset)
+		}
+		if len(r.LinksTo) != 1 || r.LinksTo[0].URL.Path != c.path {
+			t.Errorf("Expected a %s page to link to %s, got %v", c.name, c.path, r.LinksTo)
+		}
+		ts.Close()
+	}
+}
@@ -4,45 +4,334 @@
 package fetch
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/html"
 )
 
 /*
-JobResult stores the result of one link retrieval.
+Link is a link found on a page, along with the text of the anchor it was in
+(or the alt text or title, for tags that don't have any), its rel attribute if
+it had one, and what kind of link it is.
+*/
+type Link struct {
+	URL  *url.URL
+	Text string
+	Rel  string
+	Kind LinkKind
+}
+
+/*
+JobResult stores the result of one link retrieval, along with what we learnt
+about the response.
 */
 type JobResult struct {
 	FromURL *url.URL
-	LinksTo []*url.URL
+	// LinksTo are absolute, resolved against the page's <base href> if it has
+	// one, or FinalURL if it doesn't.
+	LinksTo    []Link
+	StatusCode int
+	// FinalURL is where we ended up after any redirects, and Redirects has
+	// every hop on the way there.
+	FinalURL    *url.URL
+	Redirects   []Redirect
+	ContentType string
+	// ContentLength is the number of body bytes we looked at, which is never
+	// more than Options.MaxBodySize, or for anything that isn't HTML (which
+	// we don't read), the size the server said it was.
+	ContentLength int64
+	// Truncated is set if the page was bigger than Options.MaxBodySize, so
+	// we stopped reading it.
+	Truncated bool
+	// BytesRead is how much of the body we actually downloaded, which is
+	// what a byte budget should count: it's 0 for a HEAD request, and can be
+	// a little over MaxBodySize, since we have to read past the end to know a
+	// page was cut short.
+	BytesRead int64
+	// Charset is the character set the page turned out to be in; it's
+	// converted to UTF-8 before we look for links.
+	Charset string
+	// LastModified is the server's Last-Modified header, and is zero if it
+	// didn't send one we could read.
+	LastModified time.Time
+	// ResponseTime is how long the server took to start answering.
+	ResponseTime time.Duration
+	// Err is set if the page couldn't be fetched even after retrying, in
+	// which case StatusCode is the last status we got (if we got one at
+	// all), or if we were told to stop part way through reading it.
+	Err error
+	// ReadErr is set if the page loaded, but the connection broke before we
+	// had read all of it, so LinksTo only has the links we got to.
+	ReadErr error
 }
 
 /*
-Links returns a list of JobResults - each one containing the results for one queue entry
+Options controls how hard Links is allowed to lean on the servers it talks to,
+and what it looks for in the pages it gets back. Anything left unset falls
+back to the defaults.
 */
-func Links(client *http.Client, queue []*url.URL) []JobResult {
+type Options struct {
+	// Concurrency is the maximum number of requests in flight at once
+	// overall, and PerHostConcurrency is the maximum in flight against any
+	// one host. Anything less than 1 falls back to the defaults below.
+	Concurrency        int
+	PerHostConcurrency int
+	// If HostDelay is set, requests to a host are spaced out by however long
+	// it returns for that host's URLs (this is how robots.txt Crawl-delay
+	// gets honoured).
+	HostDelay func(link *url.URL) time.Duration
+	// Limiter keeps track of the requests in flight against each host, and
+	// when the last one started. If it's nil, Links makes a new one, so
+	// anything calling Links more than once should share one between the
+	// calls to keep the same per host limits and delays throughout.
+	Limiter *HostLimiter
+	// Retries is how many more times a failed request is tried before we
+	// give up on it, DefaultRetries if it isn't set. Set NoRetries to never
+	// retry. RetryBaseDelay and RetryMaxDelay bound the backoff between
+	// attempts.
+	Retries        int
+	NoRetries      bool
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	// UserAgent is sent with every request, DefaultUserAgent if it's empty,
+	// and Headers are added to every request on top of that.
+	UserAgent string
+	Headers   http.Header
+	// Logger is where pages that couldn't be loaded or parsed get reported,
+	// the standard logger if it isn't set.
+	Logger *log.Logger
+	// LinkKinds is which kinds of link are looked for on each page, and
+	// falls back to DefaultLinkKinds if it's empty. LinkTags narrows that
+	// down to links in these tags (lowercase, like "iframe"), and falls back
+	// to DefaultLinkTags. A link has to pass both to be kept.
+	LinkKinds []LinkKind
+	LinkTags  []string
+	// MaxBodySize is the most of a page we'll read, DefaultMaxBodySize if it
+	// isn't set. Only HTML is read at all.
+	MaxBodySize int64
+	// Unless NoSniff is set, responses without a useful Content-Type have
+	// theirs worked out from the body, like a browser would.
+	NoSniff bool
+	// If FollowRedirect is set, a redirect is only followed if it returns
+	// true for where it goes. Otherwise we stop there: the hop is still in
+	// Redirects, but what it points at isn't fetched, and StatusCode is the
+	// redirect's.
+	FollowRedirect func(link *url.URL) bool
+	// If OnResult is set, Links calls it with every JobResult as soon as it's
+	// ready, rather than making you wait for the lot. It's only ever called
+	// from one goroutine at a time.
+	OnResult func(result JobResult)
+}
+
+const (
+	// DefaultConcurrency is the number of workers Links uses if not told otherwise.
+	DefaultConcurrency int = 16
+	// DefaultPerHostConcurrency is the number of requests Links will have in
+	// flight against a single host if not told otherwise.
+	DefaultPerHostConcurrency int = 4
+	// DefaultUserAgent is who we tell servers we are if not told otherwise.
+	// The URL is there so whoever is reading their logs can find out what
+	// Charlotte is.
+	DefaultUserAgent string = "go-charlotte/1.0 (+https://github.com/kn100/go-charlotte)"
+)
+
+/*
+DefaultOptions returns the Options Links uses when it isn't told otherwise.
+*/
+func DefaultOptions() Options {
+	return Options{
+		Concurrency:        DefaultConcurrency,
+		PerHostConcurrency: DefaultPerHostConcurrency,
+		Retries:            DefaultRetries,
+		RetryBaseDelay:     DefaultRetryBaseDelay,
+		RetryMaxDelay:      DefaultRetryMaxDelay,
+		UserAgent:          DefaultUserAgent,
+		MaxBodySize:        DefaultMaxBodySize,
+	}
+}
+
+/*
+withDefaults fills in any unset fields of o with the defaults.
+*/
+func (o Options) withDefaults() Options {
+	if o.Concurrency < 1 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.PerHostConcurrency < 1 {
+		o.PerHostConcurrency = DefaultPerHostConcurrency
+	}
+	if o.NoRetries {
+		o.Retries = 0
+	} else if o.Retries < 1 {
+		o.Retries = DefaultRetries
+	}
+	if o.RetryBaseDelay <= 0 {
+		o.RetryBaseDelay = DefaultRetryBaseDelay
+	}
+	if o.RetryMaxDelay <= 0 {
+		o.RetryMaxDelay = DefaultRetryMaxDelay
+	}
+	if o.UserAgent == "" {
+		o.UserAgent = DefaultUserAgent
+	}
+	if len(o.LinkKinds) == 0 {
+		o.LinkKinds = DefaultLinkKinds
+	}
+	if len(o.LinkTags) == 0 {
+		o.LinkTags = DefaultLinkTags
+	}
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = DefaultMaxBodySize
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+	return o
+}
+
+/*
+RequestHeader returns the headers every request should carry: o.Headers plus
+the User-Agent.
+*/
+func (o Options) RequestHeader() http.Header {
+	header := o.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	userAgent := o.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	header.Set("User-Agent", userAgent)
+	return header
+}
+
+/*
+NewRequest returns a GET request for link carrying opts.RequestHeader(). The
+request is abandoned if ctx is cancelled.
+*/
+func NewRequest(ctx context.Context, link *url.URL, opts Options) (*http.Request, error) {
+	return newRequest(ctx, http.MethodGet, link, opts)
+}
+
+/*
+newRequest is NewRequest for any method.
+*/
+func newRequest(ctx context.Context, method string, link *url.URL, opts Options) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, link.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = opts.RequestHeader()
+	return req, nil
+}
+
+/*
+Get fetches link the way Links fetches a page, for anything else a crawl needs
+to read: it waits its turn on opts.Limiter, follows redirects opts allows,
+retries, and sends opts.RequestHeader(). Unlike Links it hands back the
+response as it is, whatever its status. The host slot is held until the body
+is closed, so always close it.
+*/
+func Get(ctx context.Context, client *http.Client, link *url.URL, opts Options) (*http.Response, error) {
+	opts = opts.withDefaults()
+	limiter := opts.Limiter
+	if limiter == nil {
+		limiter = NewHostLimiter(opts.PerHostConcurrency)
+	}
+	slot, err := limiter.hold(ctx, link, opts.HostDelay)
+	if err != nil {
+		return nil, err
+	}
+	resp, redirects, _, err := followRedirects(ctx, client, http.MethodGet, link, opts, slot)
+	if errors.Is(err, errRedirectNotFollowed) {
+		err = fmt.Errorf("redirected to %s, which we may not follow", redirects[len(redirects)-1].Location)
+	}
+	if err != nil {
+		slot.release()
+		return nil, err
+	}
+	resp.Body = &slotBody{ReadCloser: resp.Body, slot: slot}
+	return resp, nil
+}
+
+/*
+slotBody is a response body that gives its host slot back when it's closed.
+*/
+type slotBody struct {
+	io.ReadCloser
+	slot *hostSlot
+	once sync.Once
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.slot.release)
+	return err
+}
+
+/*
+Links returns a list of JobResults - each one containing the results for one
+queue entry. At most opts.Concurrency requests are made at once, and at most
+opts.PerHostConcurrency of those go to the same host.
+URLs that look like files (.pdf, .zip and so on) get a HEAD request first, so
+we don't download them just to find out they aren't pages.
+If ctx is cancelled, no new requests are started and the ones in flight are
+abandoned with ctx's error. Links still returns whatever it managed to get, but
+queue entries that were never started have no JobResult at all.
+*/
+func Links(ctx context.Context, client *http.Client, queue []*url.URL, opts Options) []JobResult {
+	opts = opts.withDefaults()
 
 	var jobResults []JobResult
 	// This channel is used for communication between producers and the consumer.
 	done := make(chan JobResult)
+	// This channel hands work out to the producers.
+	jobs := make(chan *url.URL)
+	limiter := opts.Limiter
+	if limiter == nil {
+		limiter = NewHostLimiter(opts.PerHostConcurrency)
+	}
 	var producerWaitGroup sync.WaitGroup
 	var consumerWaitGroup sync.WaitGroup
-	for len(queue) > 0 {
+
+	// There's no point starting more workers than there is work.
+	workers := opts.Concurrency
+	if workers > len(queue) {
+		workers = len(queue)
+	}
+	for i := 0; i < workers; i++ {
 		producerWaitGroup.Add(1)
+		go linkProducer(ctx, client, opts, jobs, done, limiter, &producerWaitGroup)
+	}
+	consumerWaitGroup.Add(1)
+	go linkConsumer(done, &jobResults, opts.OnResult, &consumerWaitGroup)
 
+dispatch:
+	for len(queue) > 0 {
 		// This is effectively a dequeue operation
 		toProcess := queue[0]
 		queue = queue[1:]
 
-		// give the work to a goroutine to do it!
-		go getLinksForSingleURL(client, toProcess, done, &producerWaitGroup)
+		// give the work to whichever producer is free first
+		select {
+		case jobs <- toProcess:
+		case <-ctx.Done():
+			// Nobody should start on the rest, so stop handing it out.
+			break dispatch
+		}
 	}
-	consumerWaitGroup.Add(1)
-	go linkConsumer(done, &jobResults, &consumerWaitGroup)
+	// No more work is coming, so the producers can quit once they're done.
+	close(jobs)
 	// We cannot proceed until every producer has finished.
 	producerWaitGroup.Wait()
 	// Nothing else will be written to this channel, so close it. This will
@@ -53,67 +342,254 @@ func Links(client *http.Client, queue []*url.URL) []JobResult {
 }
 
 /*
-getLinksForSingleURL is the 'job' that Links runs. It returns the JobResult via the channel
+linkProducer is a worker. It takes URLs off the jobs channel until it is
+closed, waiting for a free slot on the URL's host (and for any crawl delay to
+pass) before fetching it. If ctx is cancelled while it's waiting, the URL is
+dropped.
 */
-func getLinksForSingleURL(client *http.Client, url *url.URL, done chan JobResult, wg *sync.WaitGroup) {
-	links := JobResult{FromURL: url, LinksTo: nil}
+func linkProducer(ctx context.Context, client *http.Client, opts Options, jobs chan *url.URL, done chan JobResult, limiter *HostLimiter, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for toProcess := range jobs {
+		slot, err := limiter.hold(ctx, toProcess, opts.HostDelay)
+		if err != nil {
+			continue
+		}
+		getLinksForSingleURL(ctx, client, toProcess, opts, slot, done)
+		slot.release()
+	}
+}
 
-	resp, err := client.Get(url.String())
+/*
+getLinksForSingleURL is the 'job' that Links runs. It returns the JobResult via
+the channel. slot is the host slot it was started with, and is moved along with
+every request it makes after the first.
+*/
+func getLinksForSingleURL(ctx context.Context, client *http.Client, pageURL *url.URL, opts Options, slot *hostSlot, done chan JobResult) {
+	links := JobResult{FromURL: pageURL, LinksTo: nil}
+
+	if looksNonHTML(pageURL) {
+		// It's probably a file, so ask what it is before downloading it.
+		if probed, settled := probe(ctx, client, pageURL, opts, slot); settled {
+			done <- probed
+			return
+		}
+	}
+
+	resp, redirects, elapsed, err := followRedirects(ctx, client, http.MethodGet, pageURL, opts, slot)
 	if err != nil {
-		// We could implement some retry logic here. I didn't though!
-		log.Printf("Loading failed for link %s. Pretending it has no links. Err: %s\n", url.String(), err)
-		done <- links
+		done <- unfinished(pageURL, redirects, elapsed, err, opts)
 		return
 	}
+	links.ResponseTime = elapsed
+	links.Redirects = redirects
 	defer resp.Body.Close()
+	links.StatusCode = resp.StatusCode
+	links.FinalURL = resp.Request.URL
+	links.ContentType = resp.Header.Get("Content-Type")
+	links.LastModified = lastModified(resp.Header)
 
-	z := html.NewTokenizer(resp.Body)
+	// Everything we take off the wire goes through here, sniffing included.
+	downloaded := &countingReader{r: resp.Body}
+	var content io.Reader = downloaded
+	contentType := links.ContentType
+	if !opts.NoSniff && needsSniffing(contentType) {
+		contentType, content = sniff(downloaded)
+		if links.ContentType == "" {
+			links.ContentType = contentType
+		}
+	}
+	if contentType != "" && !isHTML(contentType) {
+		// Not a page, so there are no links in it and no point reading it.
+		if resp.ContentLength > 0 {
+			links.ContentLength = resp.ContentLength
+		}
+		links.BytesRead = downloaded.n
+		done <- links
+		return
+	}
+
+	wanted := make(map[LinkKind]bool)
+	for _, kind := range opts.LinkKinds {
+		wanted[kind] = true
+	}
+	wantedTags := make(map[string]bool)
+	for _, tag := range opts.LinkTags {
+		wantedTags[strings.ToLower(tag)] = true
+	}
+	// Reading one byte past the limit is how we tell a page that's exactly
+	// MaxBodySize from one that's bigger.
+	body := &countingReader{r: io.LimitReader(content, opts.MaxBodySize+1)}
+	// Relative links are relative to wherever we ended up after redirects,
+	// unless the page has a <base href> saying otherwise. The <base> can
+	// come after some of the links, so they're all resolved at the end.
+	base := resp.Request.URL
+	sawBase := false
+	finish := func() {
+		for i := range links.LinksTo {
+			links.LinksTo[i].URL = base.ResolveReference(links.LinksTo[i].URL)
+		}
+		links.ContentLength = body.n
+		links.BytesRead = downloaded.n
+		if body.n > opts.MaxBodySize {
+			links.ContentLength = opts.MaxBodySize
+			links.Truncated = true
+			opts.Logger.Printf("%s is bigger than %d bytes, so we only looked at the start of it.\n", pageURL, opts.MaxBodySize)
+		}
+		done <- links
+	}
+	// Only the Content-Type the server sent can say what charset the page is
+	// in. A sniffed one always says UTF-8.
+	decoded, charsetName := decode(body, resp.Header.Get("Content-Type"))
+	links.Charset = charsetName
+	z := html.NewTokenizer(decoded)
+	// While we're inside an <a>, this is where it sits in links.LinksTo, so
+	// we can collect up its text. -1 means we aren't in one.
+	openAnchor := -1
+	var anchorText []string
+	closeAnchor := func() {
+		if openAnchor >= 0 {
+			links.LinksTo[openAnchor].Text = strings.Join(strings.Fields(strings.Join(anchorText, " ")), " ")
+		}
+		openAnchor = -1
+		anchorText = nil
+	}
 	for {
 		tt := z.Next()
 
 		switch {
 		case tt == html.ErrorToken:
 			err := z.Err()
+			closeAnchor()
 			if err == io.EOF {
 				// End of the file, break out of the loop
-				done <- links
-				wg.Done()
+				finish()
 				return
 			}
-			// There's been an error. We should probably deal with this more
-			// gracefully, but for now log and return the links we did get.
-			log.Println("There was an error parsing the html.", err)
-			done <- links
+			// We didn't get the whole page, so what it links to is only
+			// some of the story. If that's because we were told to stop,
+			// the error we get is the connection being closed on us, so
+			// say why it was closed. Otherwise the page itself was fine,
+			// we just didn't get all of it.
+			if ctx.Err() != nil {
+				err = fmt.Errorf("%w (%s)", ctx.Err(), err)
+				links.Err = err
+			} else {
+				links.ReadErr = err
+			}
+			opts.Logger.Printf("Reading failed for link %s. Err: %s\n", pageURL.String(), err)
+			finish()
 			return
 
-		case tt == html.StartTagToken:
+		case tt == html.TextToken:
+			if openAnchor >= 0 {
+				anchorText = append(anchorText, string(z.Text()))
+			}
+
+		case tt == html.EndTagToken:
+			if t := z.Token(); t.Data == "a" {
+				closeAnchor()
+			}
+
+		case tt == html.StartTagToken || tt == html.SelfClosingTagToken:
 			t := z.Token()
 
-			if t.Data == "a" {
-				// We've found <a>!
-				link := getHref(t)
-				if link != "" {
-					foundLink, err := url.Parse(link)
-					if err != nil {
-						// Looks like garbage in the href tag. Leave it out.
-						log.Printf("Wasn't able to parse %s. Ignoring. Error %s\n", link, err)
-					} else {
-						links.LinksTo = append(links.LinksTo, foundLink)
+			if t.Data == "img" && openAnchor >= 0 {
+				// An image link has no text, but the alt text is a good stand in.
+				anchorText = append(anchorText, getAttr(t, "alt"))
+			}
+
+			if t.Data == "base" && !sawBase {
+				// Only the first <base> with an href counts.
+				if href := getHref(t); href != "" {
+					if baseURL, err := url.Parse(strings.TrimSpace(href)); err == nil {
+						base = base.ResolveReference(baseURL)
+						sawBase = true
 					}
 				}
 			}
+
+			if t.Data == "a" {
+				// We've found <a>! Anchors don't nest, so this closes any
+				// anchor we were already in.
+				closeAnchor()
+			}
+			if !wantedTags[t.Data] {
+				continue
+			}
+			for _, found := range linksInTag(t) {
+				if !wanted[found.kind] {
+					continue
+				}
+				foundLink, err := url.Parse(found.href)
+				if err != nil {
+					// Looks like garbage in the tag. Leave it out.
+					opts.Logger.Printf("Wasn't able to parse %s. Ignoring. Error %s\n", found.href, err)
+					continue
+				}
+				links.LinksTo = append(links.LinksTo, Link{URL: foundLink, Text: found.text, Rel: found.rel, Kind: found.kind})
+				if t.Data == "a" {
+					openAnchor = len(links.LinksTo) - 1
+				}
+			}
 		}
 	}
 }
 
+/*
+unfinished returns the JobResult for link when followRedirects gave up on it
+with err, having taken redirects to get there. A redirect we weren't allowed
+to follow isn't a failure: we just stop at that hop.
+*/
+func unfinished(link *url.URL, redirects []Redirect, elapsed time.Duration, err error, opts Options) JobResult {
+	result := JobResult{FromURL: link, ResponseTime: elapsed, Redirects: redirects}
+	if errors.Is(err, errRedirectNotFollowed) {
+		last := redirects[len(redirects)-1]
+		opts.Logger.Printf("Not following the redirect from %s to %s.\n", last.URL, last.Location)
+		result.StatusCode = last.StatusCode
+		return result
+	}
+	opts.Logger.Printf("Loading failed for link %s. Err: %s\n", link.String(), err)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		result.StatusCode = statusErr.StatusCode
+	} else if len(redirects) > 0 {
+		// We got answers, they just never stopped redirecting.
+		result.StatusCode = redirects[len(redirects)-1].StatusCode
+	}
+	result.Err = err
+	return result
+}
+
+/*
+countingReader counts the bytes read through it.
+*/
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 /*
 getHref will when given a html.Token, find the href key and returns it.
 If it cannot find a href, it returns the empty string.
 */
 func getHref(t html.Token) string {
-	// Iterate over all of the Token's attributes until we find an "href"
+	return getAttr(t, "href")
+}
+
+/*
+getAttr returns the value of the named attribute of a html.Token, or the empty
+string if it doesn't have one.
+*/
+func getAttr(t html.Token, key string) string {
+	// Iterate over all of the Token's attributes until we find the one we want
 	for _, a := range t.Attr {
-		if a.Key == "href" {
+		if a.Key == key {
 			return a.Val
 		}
 	}
@@ -122,13 +598,15 @@ func getHref(t html.Token) string {
 
 /*
 linkConsumer ranges on a channel, appending the data it gets from it onto job
-results array you passed it. Since this is one single goroutine, this is
-threadsafe (but kinda cheaty)
+results array you passed it, and passing it to onResult if that isn't nil.
+Since this is one single goroutine, this is threadsafe (but kinda cheaty)
 */
-func linkConsumer(j chan JobResult, results *[]JobResult, wg *sync.WaitGroup) {
+func linkConsumer(j chan JobResult, results *[]JobResult, onResult func(JobResult), wg *sync.WaitGroup) {
 	for s := range j {
 		*results = append(*results, s)
-
+		if onResult != nil {
+			onResult(s)
+		}
 	}
 	wg.Done()
 }
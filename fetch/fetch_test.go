@@ -0,0 +1,668 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+concurrencyServer returns a test server that tracks the most requests it has
+seen in flight at once. Every page links back to the root.
+*/
+func concurrencyServer(maxSeen *int) *httptest.Server {
+	var mu sync.Mutex
+	inFlight := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > *maxSeen {
+			*maxSeen = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, `<html><body><a href="/">home</a></body></html>`)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+}
+
+func makeQueue(t *testing.T, base string, n int) []*url.URL {
+	var queue []*url.URL
+	for i := 0; i < n; i++ {
+		u, err := url.Parse(fmt.Sprintf("%s/page/%d", base, i))
+		if err != nil {
+			t.Fatalf("Couldn't parse test URL. Err: %s", err)
+		}
+		queue = append(queue, u)
+	}
+	return queue
+}
+
+func TestLinksReturnsResultPerURL(t *testing.T) {
+	maxSeen := 0
+	ts := concurrencyServer(&maxSeen)
+	defer ts.Close()
+
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 10), DefaultOptions())
+	if len(results) != 10 {
+		t.Fatalf("Expected 10 results, got %d", len(results))
+	}
+	expected := ts.URL + "/"
+	for _, r := range results {
+		if len(r.LinksTo) != 1 || r.LinksTo[0].URL.String() != expected {
+			t.Errorf("Expected %s to link to %s, got %v", r.FromURL, expected, r.LinksTo)
+		}
+	}
+}
+
+func TestLinksCallsOnResult(t *testing.T) {
+	maxSeen := 0
+	ts := concurrencyServer(&maxSeen)
+	defer ts.Close()
+
+	seen := make(map[string]bool)
+	opts := DefaultOptions()
+	opts.OnResult = func(result JobResult) {
+		seen[result.FromURL.String()] = true
+	}
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 10), opts)
+	if len(seen) != 10 {
+		t.Errorf("Expected OnResult to be called for all 10 URLs, got %d", len(seen))
+	}
+	for _, r := range results {
+		if !seen[r.FromURL.String()] {
+			t.Errorf("OnResult was never called for %s", r.FromURL)
+		}
+	}
+}
+
+func TestLinksRecordsResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<a href="/">home</a>`)
+	}))
+	defer ts.Close()
+
+	old, _ := url.Parse(ts.URL + "/old")
+	results := Links(context.Background(), ts.Client(), []*url.URL{old}, DefaultOptions())
+	r := results[0]
+	if r.StatusCode != http.StatusOK {
+		t.Errorf("Expected a 200, got %d", r.StatusCode)
+	}
+	if r.FinalURL == nil || r.FinalURL.String() != ts.URL+"/new" {
+		t.Errorf("Expected to end up at %s/new, got %v", ts.URL, r.FinalURL)
+	}
+	if r.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("Expected the content type to be recorded, got %s", r.ContentType)
+	}
+	if r.ContentLength != int64(len(`<a href="/">home</a>`)) || r.BytesRead != r.ContentLength {
+		t.Errorf("Expected the body length to be recorded, got %d (%d bytes read)", r.ContentLength, r.BytesRead)
+	}
+	if r.ResponseTime <= 0 {
+		t.Errorf("Expected a response time to be recorded")
+	}
+}
+
+func TestLinksCollectsAnchorText(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<p><a href="/about">About
+			<b>me</b></a> and <a href="/cv" rel="nofollow"><img src="cv.png" alt="My CV"></a> <a href="/empty"></a></p>`)
+	}))
+	defer ts.Close()
+
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), DefaultOptions())
+	expected := []string{"About me", "My CV", ""}
+	if len(results[0].LinksTo) != len(expected) {
+		t.Fatalf("Expected %d links, got %d", len(expected), len(results[0].LinksTo))
+	}
+	for i, text := range expected {
+		if results[0].LinksTo[i].Text != text {
+			t.Errorf("Expected link %d to have text '%s', got '%s'", i, text, results[0].LinksTo[i].Text)
+		}
+	}
+	if results[0].LinksTo[1].Rel != "nofollow" {
+		t.Errorf("Expected the rel attribute to be recorded, got '%s'", results[0].LinksTo[1].Rel)
+	}
+}
+
+func TestLinksResolvesRelativeLinks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old/":
+			http.Redirect(w, r, "/blog/post/", http.StatusMovedPermanently)
+		case "/blog/post/":
+			fmt.Fprint(w, `<a href="../about">About</a><a href="next">Next</a><a href="/top">Top</a>`)
+		case "/based/page":
+			fmt.Fprint(w, `<a href="before">Before</a><base href="/docs/v2/"><base href="/ignored/"><a href="after">After</a>`)
+		}
+	}))
+	defer ts.Close()
+
+	cases := map[string][]string{
+		"/old/":       {"/blog/about", "/blog/post/next", "/top"},
+		"/based/page": {"/docs/v2/before", "/docs/v2/after"},
+	}
+	for path, expected := range cases {
+		page, _ := url.Parse(ts.URL + path)
+		results := Links(context.Background(), ts.Client(), []*url.URL{page}, DefaultOptions())
+		if len(results[0].LinksTo) != len(expected) {
+			t.Fatalf("Expected %d links on %s, got %v", len(expected), path, results[0].LinksTo)
+		}
+		for i, link := range results[0].LinksTo {
+			if link.URL.String() != ts.URL+expected[i] {
+				t.Errorf("Expected link %d on %s to be %s, got %s", i, path, ts.URL+expected[i], link.URL)
+			}
+		}
+	}
+}
+
+func TestLinksRecordsRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusFound)
+		default:
+			fmt.Fprint(w, `<a href="d">D</a>`)
+		}
+	}))
+	defer ts.Close()
+
+	a, _ := url.Parse(ts.URL + "/a")
+	r := Links(context.Background(), ts.Client(), []*url.URL{a}, DefaultOptions())[0]
+	expected := []Redirect{
+		{URL: ts.URL + "/a", StatusCode: http.StatusMovedPermanently, Location: ts.URL + "/b"},
+		{URL: ts.URL + "/b", StatusCode: http.StatusFound, Location: ts.URL + "/c"},
+	}
+	if len(r.Redirects) != len(expected) {
+		t.Fatalf("Expected %d redirects, got %+v", len(expected), r.Redirects)
+	}
+	for i := range expected {
+		if r.Redirects[i] != expected[i] {
+			t.Errorf("Expected hop %d to be %+v, got %+v", i, expected[i], r.Redirects[i])
+		}
+	}
+	if r.StatusCode != http.StatusOK || r.FinalURL.String() != ts.URL+"/c" {
+		t.Errorf("Expected to end up at /c with a 200, got %d at %s", r.StatusCode, r.FinalURL)
+	}
+	if len(r.LinksTo) != 1 || r.LinksTo[0].URL.String() != ts.URL+"/d" {
+		t.Errorf("Expected links to be resolved against /c, got %v", r.LinksTo)
+	}
+}
+
+func TestLinksStopsAtRedirectsItMayNotFollow(t *testing.T) {
+	var fetchedElsewhere bool
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetchedElsewhere = true
+	}))
+	defer elsewhere.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		default:
+			http.Redirect(w, r, elsewhere.URL+"/c", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	elsewhereURL, _ := url.Parse(elsewhere.URL)
+	opts := DefaultOptions()
+	opts.FollowRedirect = func(link *url.URL) bool {
+		return link.Host != elsewhereURL.Host
+	}
+	a, _ := url.Parse(ts.URL + "/a")
+	r := Links(context.Background(), ts.Client(), []*url.URL{a}, opts)[0]
+	if fetchedElsewhere {
+		t.Errorf("The redirect to %s shouldn't have been followed", elsewhere.URL)
+	}
+	if r.Err != nil || r.FinalURL != nil || r.StatusCode != http.StatusFound {
+		t.Errorf("Expected to stop at the 302 without an error, got %d at %s (%v)", r.StatusCode, r.FinalURL, r.Err)
+	}
+	if len(r.Redirects) != 2 || r.Redirects[1].Location != elsewhere.URL+"/c" {
+		t.Errorf("Expected both hops to be recorded, got %+v", r.Redirects)
+	}
+}
+
+func TestLinksDetectsRedirectLoops(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/a", http.StatusFound)
+		default:
+			// Always somewhere new, so it never loops.
+			http.Redirect(w, r, r.URL.Path+"x", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	a, _ := url.Parse(ts.URL + "/a")
+	endless, _ := url.Parse(ts.URL + "/x")
+	results := Links(context.Background(), ts.Client(), []*url.URL{a, endless}, DefaultOptions())
+	for _, r := range results {
+		expectedErr := ErrTooManyRedirects
+		if r.FromURL == a {
+			expectedErr = ErrRedirectLoop
+			if len(r.Redirects) != 2 {
+				t.Errorf("Expected both hops of the loop to be recorded, got %+v", r.Redirects)
+			}
+		}
+		if !errors.Is(r.Err, expectedErr) {
+			t.Errorf("Expected %s to fail with %s, got %v", r.FromURL, expectedErr, r.Err)
+		}
+		if r.StatusCode != http.StatusFound {
+			t.Errorf("Expected the last redirect's status to be recorded, got %d", r.StatusCode)
+		}
+	}
+}
+
+func TestLinksKinds(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<head><link rel="stylesheet" href="/style.css"><meta http-equiv="refresh" content="5; url=/next"></head>
+			<body><a href="/about"><img src="/me.png" alt="Me"></a><form action="/search"></form></body>`)
+	}))
+	defer ts.Close()
+
+	kindsOf := func(opts Options) map[string]LinkKind {
+		results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), opts)
+		kinds := make(map[string]LinkKind)
+		for _, link := range results[0].LinksTo {
+			kinds[link.URL.Path] = link.Kind
+		}
+		return kinds
+	}
+
+	kinds := kindsOf(DefaultOptions())
+	if len(kinds) != 2 || kinds["/about"] != KindNavigation || kinds["/next"] != KindRefresh {
+		t.Errorf("Expected only the page links by default, got %v", kinds)
+	}
+
+	opts := DefaultOptions()
+	opts.LinkKinds = []LinkKind{KindNavigation, KindRefresh, KindForm, KindResource}
+	kinds = kindsOf(opts)
+	expected := map[string]LinkKind{
+		"/style.css": KindResource,
+		"/next":      KindRefresh,
+		"/about":     KindNavigation,
+		"/me.png":    KindResource,
+		"/search":    KindForm,
+	}
+	if len(kinds) != len(expected) {
+		t.Errorf("Expected %d links, got %v", len(expected), kinds)
+	}
+	for path, kind := range expected {
+		if kinds[path] != kind {
+			t.Errorf("Expected %s to be a %s link, got %q", path, kind, kinds[path])
+		}
+	}
+}
+
+func TestLinksTags(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<head><link rel="next" href="/page/2"></head>
+			<body><a href="/about">About</a><iframe src="/frame"></iframe></body>`)
+	}))
+	defer ts.Close()
+
+	opts := DefaultOptions()
+	opts.LinkTags = []string{"a", "iframe"}
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), opts)
+	var paths []string
+	for _, link := range results[0].LinksTo {
+		paths = append(paths, link.URL.Path)
+	}
+	if len(paths) != 2 || paths[0] != "/about" || paths[1] != "/frame" {
+		t.Errorf("Expected only the links in <a> and <iframe>, got %v", paths)
+	}
+}
+
+func TestLinksSendsUserAgentAndHeaders(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer ts.Close()
+
+	Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), DefaultOptions())
+	if got.Get("User-Agent") != DefaultUserAgent {
+		t.Errorf("Expected the default User-Agent, got %s", got.Get("User-Agent"))
+	}
+
+	opts := DefaultOptions()
+	opts.UserAgent = "test-bot/2.0"
+	opts.Headers = http.Header{"X-Crawl-Id": []string{"42"}, "User-Agent": []string{"ignored"}}
+	Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), opts)
+	if got.Get("User-Agent") != "test-bot/2.0" {
+		t.Errorf("Expected UserAgent to win over Headers, got %s", got.Get("User-Agent"))
+	}
+	if got.Get("X-Crawl-Id") != "42" {
+		t.Errorf("Expected the extra header to be sent, got %v", got)
+	}
+}
+
+func TestLinksStopsWhenCancelled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	opts := Options{Concurrency: 2, Retries: 3}
+	results := Links(ctx, ts.Client(), makeQueue(t, ts.URL, 10), opts)
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Links should have stopped soon after being cancelled, took %s", time.Since(start))
+	}
+	if len(results) > 2 {
+		t.Errorf("Only the 2 requests in flight should have results, got %d", len(results))
+	}
+	for _, r := range results {
+		if !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Errorf("Expected %s to fail with the context's error, got %v", r.FromURL, r.Err)
+		}
+	}
+}
+
+func TestLinksStopsWhenCancelledMidPage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<a href="/first">First</a>`)
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprint(w, `<a href="/second">Second</a>`)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results := Links(ctx, ts.Client(), makeQueue(t, ts.URL, 1), Options{})
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	if !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Errorf("Expected a page cut short by the context to fail with its error, got %v", results[0].Err)
+	}
+}
+
+func TestLinksRecordsPagesCutShort(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		// Promise more than we send, so the connection is dropped part way.
+		w.Header().Set("Content-Length", "1000")
+		fmt.Fprint(w, `<a href="/first">First</a>`)
+	}))
+	defer ts.Close()
+
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), Options{})
+	if results[0].Err != nil {
+		t.Errorf("Expected a page cut short not to count as failing, got %v", results[0].Err)
+	}
+	if !errors.Is(results[0].ReadErr, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected ReadErr to say the page was cut short, got %v", results[0].ReadErr)
+	}
+	if results[0].StatusCode != http.StatusOK || len(results[0].LinksTo) != 1 {
+		t.Errorf("Expected the status and the links we got to to be kept, got %d %v", results[0].StatusCode, results[0].LinksTo)
+	}
+}
+
+func TestLinksGlobalConcurrency(t *testing.T) {
+	maxSeen := 0
+	ts := concurrencyServer(&maxSeen)
+	defer ts.Close()
+
+	Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 20), Options{Concurrency: 3, PerHostConcurrency: 10})
+	if maxSeen > 3 {
+		t.Errorf("Expected at most 3 requests in flight, saw %d", maxSeen)
+	}
+}
+
+func TestLinksPerHostConcurrency(t *testing.T) {
+	maxSeen := 0
+	ts := concurrencyServer(&maxSeen)
+	defer ts.Close()
+
+	Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 20), Options{Concurrency: 10, PerHostConcurrency: 2})
+	if maxSeen > 2 {
+		t.Errorf("Expected at most 2 requests in flight against one host, saw %d", maxSeen)
+	}
+}
+
+func TestLinksPerHostConcurrencyAcrossRedirects(t *testing.T) {
+	maxSeen := 0
+	target := concurrencyServer(&maxSeen)
+	defer target.Close()
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer redirecting.Close()
+
+	queue := append(makeQueue(t, target.URL, 5), makeQueue(t, redirecting.URL, 5)...)
+	Links(context.Background(), target.Client(), queue, Options{Concurrency: 10, PerHostConcurrency: 1})
+	if maxSeen > 1 {
+		t.Errorf("Expected redirects to wait for a slot on the host they go to, saw %d requests in flight", maxSeen)
+	}
+}
+
+func TestLinksCrawlDelayAcrossRedirects(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer target.Close()
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer redirecting.Close()
+
+	targetURL, _ := url.Parse(target.URL)
+	opts := Options{Concurrency: 2, HostDelay: func(link *url.URL) time.Duration {
+		if link.Host == targetURL.Host {
+			return 100 * time.Millisecond
+		}
+		return 0
+	}}
+	queue := append(makeQueue(t, target.URL, 1), makeQueue(t, redirecting.URL, 1)...)
+	Links(context.Background(), target.Client(), queue, opts)
+	if len(times) != 2 {
+		t.Fatalf("Expected 2 requests to the target, got %d", len(times))
+	}
+	if gap := times[1].Sub(times[0]); gap < 90*time.Millisecond {
+		t.Errorf("Expected the redirected request to wait out the crawl delay, only %s apart", gap)
+	}
+}
+
+func TestLinksCrawlDelayAcrossCalls(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	opts := Options{
+		HostDelay: func(link *url.URL) time.Duration { return 100 * time.Millisecond },
+		Limiter:   NewHostLimiter(0),
+	}
+	Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), opts)
+	Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), opts)
+	if len(times) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(times))
+	}
+	if gap := times[1].Sub(times[0]); gap < 90*time.Millisecond {
+		t.Errorf("Expected a shared Limiter to keep the crawl delay between calls, only %s apart", gap)
+	}
+}
+
+func TestLinksCrawlDelayBetweenRetries(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		attempt := len(times)
+		mu.Unlock()
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	opts := fastRetries(1)
+	opts.HostDelay = func(link *url.URL) time.Duration { return 100 * time.Millisecond }
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), opts)
+	if results[0].Err != nil {
+		t.Fatalf("Expected the retry to succeed. Err: %s", results[0].Err)
+	}
+	if len(times) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(times))
+	}
+	if gap := times[1].Sub(times[0]); gap < 90*time.Millisecond {
+		t.Errorf("Expected the retry to wait out the crawl delay, only %s apart", gap)
+	}
+}
+
+func TestLinksEmptyQueue(t *testing.T) {
+	results := Links(context.Background(), http.DefaultClient, nil, DefaultOptions())
+	if len(results) != 0 {
+		t.Errorf("Expected no results for an empty queue, got %d", len(results))
+	}
+}
+
+/*
+flakyServer fails the first failures requests with status, then serves a page
+with one link on it.
+*/
+func flakyServer(failures int, status int, header http.Header) (*httptest.Server, *int) {
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		attempt := requests
+		mu.Unlock()
+		if attempt <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		fmt.Fprint(w, `<a href="/ok">ok</a>`)
+	}))
+	return ts, &requests
+}
+
+func fastRetries(retries int) Options {
+	return Options{Retries: retries, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 10 * time.Millisecond}
+}
+
+func TestLinksRetriesServerErrors(t *testing.T) {
+	ts, requests := flakyServer(2, http.StatusServiceUnavailable, nil)
+	defer ts.Close()
+
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), fastRetries(3))
+	if results[0].Err != nil {
+		t.Errorf("Expected the third attempt to succeed. Err: %s", results[0].Err)
+	}
+	if len(results[0].LinksTo) != 1 {
+		t.Errorf("Expected the links from the successful attempt, got %v", results[0].LinksTo)
+	}
+	if *requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", *requests)
+	}
+}
+
+func TestLinksGivesUpAndRecordsError(t *testing.T) {
+	ts, requests := flakyServer(10, http.StatusInternalServerError, nil)
+	defer ts.Close()
+
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), fastRetries(1))
+	var statusErr *StatusError
+	if !errors.As(results[0].Err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected a StatusError for 500, got %v", results[0].Err)
+	}
+	if *requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", *requests)
+	}
+}
+
+func TestLinksGivesUpOnLongRetryAfter(t *testing.T) {
+	header := http.Header{"Retry-After": []string{"3600"}}
+	ts, requests := flakyServer(10, http.StatusTooManyRequests, header)
+	defer ts.Close()
+
+	results := Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), fastRetries(3))
+	if results[0].Err == nil {
+		t.Errorf("Expected to give up rather than wait an hour")
+	}
+	if *requests != 1 {
+		t.Errorf("Expected 1 request, got %d", *requests)
+	}
+}
+
+func TestLinksDoesNotRetryClientErrors(t *testing.T) {
+	ts, requests := flakyServer(10, http.StatusNotFound, nil)
+	defer ts.Close()
+
+	Links(context.Background(), ts.Client(), makeQueue(t, ts.URL, 1), fastRetries(3))
+	if *requests != 1 {
+		t.Errorf("Expected a 404 not to be retried, got %d requests", *requests)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	if _, ok := retryAfter(resp); ok {
+		t.Errorf("No header should mean no Retry-After")
+	}
+	resp.Header.Set("Retry-After", "120")
+	if wait, ok := retryAfter(resp); !ok || wait != 2*time.Minute {
+		t.Errorf("Expected 2m, got %s", wait)
+	}
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if wait, ok := retryAfter(resp); !ok || wait < 59*time.Minute {
+		t.Errorf("Expected about an hour, got %s", wait)
+	}
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	opts := Options{RetryBaseDelay: 100 * time.Millisecond, RetryMaxDelay: time.Second}
+	for attempt := 0; attempt < 10; attempt++ {
+		wait := backoff(attempt, opts)
+		if wait > time.Second {
+			t.Errorf("Attempt %d waited %s, longer than the max", attempt, wait)
+		}
+	}
+	if wait := backoff(0, opts); wait < 50*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("Expected the first wait to be between 50ms and 100ms, got %s", wait)
+	}
+}
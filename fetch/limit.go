@@ -0,0 +1,215 @@
+package fetch
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+HostLimiter hands out a fixed number of slots per host. Each host gets its own
+buffered channel, created the first time we see it, and holding a slot is just
+having a value sitting in that channel. started records when the last request
+to each host started, so hosts that have asked us to slow down can be spaced
+out. Links makes a new one every call unless Options.Limiter is set, so a
+crawl that calls Links more than once should share one between the calls.
+*/
+type HostLimiter struct {
+	perHost int
+	mu      sync.Mutex
+	slots   map[string]chan struct{}
+	started map[string]time.Time
+}
+
+/*
+NewHostLimiter returns a HostLimiter allowing perHost concurrent requests per
+host, or DefaultPerHostConcurrency if perHost is less than 1.
+*/
+func NewHostLimiter(perHost int) *HostLimiter {
+	if perHost < 1 {
+		perHost = DefaultPerHostConcurrency
+	}
+	return &HostLimiter{
+		perHost: perHost,
+		slots:   make(map[string]chan struct{}),
+		started: make(map[string]time.Time),
+	}
+}
+
+/*
+acquire blocks until there is a free slot for host, then takes it. If delay is
+positive, it first waits until at least delay has passed since the last
+request to host started, without holding a slot while it does. If ctx is
+cancelled first, it gives up, returns ctx's error, and doesn't hold a slot.
+*/
+func (l *HostLimiter) acquire(ctx context.Context, host string, delay time.Duration) error {
+	for {
+		if err := l.waitTurn(ctx, host, delay); err != nil {
+			return err
+		}
+		select {
+		case l.hostSlots(host) <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if l.start(host, delay) {
+			return nil
+		}
+		// Another request to host started while we were getting the slot,
+		// so we have to wait for the turn after it.
+		l.release(host)
+	}
+}
+
+/*
+waitTurn waits until delay has passed since the last request to host started.
+*/
+func (l *HostLimiter) waitTurn(ctx context.Context, host string, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	wait := time.Until(l.started[host].Add(delay))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+start records a request to host starting now, as long as delay has passed
+since the last one. It returns whether it did.
+*/
+func (l *HostLimiter) start(host string, delay time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if delay > 0 && now.Before(l.started[host].Add(delay)) {
+		return false
+	}
+	l.started[host] = now
+	return true
+}
+
+/*
+release gives back a slot taken by acquire.
+*/
+func (l *HostLimiter) release(host string) {
+	<-l.hostSlots(host)
+}
+
+/*
+hostSlots returns the slot channel for host, creating it if necessary.
+*/
+func (l *HostLimiter) hostSlots(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots, ok := l.slots[host]
+	if !ok {
+		slots = make(chan struct{}, l.perHost)
+		l.slots[host] = slots
+	}
+	return slots
+}
+
+/*
+hostSlot is a slot taken from a HostLimiter for one job. A job can make more
+than one request, and redirects can send it to other hosts, so before every
+request after the first it moves the slot to wherever that request is going,
+waiting out any delay that host has asked for. held is false if a move was
+cancelled part way, in which case there's nothing to release.
+*/
+type hostSlot struct {
+	limiter   *HostLimiter
+	hostDelay func(link *url.URL) time.Duration
+	host      string
+	held      bool
+	used      bool
+}
+
+/*
+hold takes a slot for link's host, waiting for hostDelay's delay if it's set,
+like acquire.
+*/
+func (l *HostLimiter) hold(ctx context.Context, link *url.URL, hostDelay func(link *url.URL) time.Duration) (*hostSlot, error) {
+	slot := &hostSlot{limiter: l, hostDelay: hostDelay}
+	if err := slot.take(ctx, link); err != nil {
+		return nil, err
+	}
+	return slot, nil
+}
+
+/*
+before is called before each request the job makes. The slot was taken for
+the first one, so it only gives up the slot and takes one for link's host for
+the ones after that. It's fine to call on a nil hostSlot, which does nothing.
+*/
+func (s *hostSlot) before(ctx context.Context, link *url.URL) error {
+	if s == nil {
+		return nil
+	}
+	if !s.used && s.host == link.Host {
+		s.used = true
+		return nil
+	}
+	s.used = true
+	s.release()
+	return s.take(ctx, link)
+}
+
+/*
+pause gives the slot up for wait, so the host's other requests can go ahead
+while we back off, then takes one for link's host again, waiting out its delay
+like any other request. On a nil hostSlot it just waits.
+*/
+func (s *hostSlot) pause(ctx context.Context, link *url.URL, wait time.Duration) error {
+	if s != nil {
+		s.release()
+	}
+	timer := time.NewTimer(wait)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	}
+	if s == nil {
+		return nil
+	}
+	return s.take(ctx, link)
+}
+
+/*
+take acquires a slot for link's host.
+*/
+func (s *hostSlot) take(ctx context.Context, link *url.URL) error {
+	var delay time.Duration
+	if s.hostDelay != nil {
+		delay = s.hostDelay(link)
+	}
+	if err := s.limiter.acquire(ctx, link.Host, delay); err != nil {
+		return err
+	}
+	s.host = link.Host
+	s.held = true
+	return nil
+}
+
+/*
+release gives the slot back, if it's holding one.
+*/
+func (s *hostSlot) release() {
+	if s.held {
+		s.limiter.release(s.host)
+		s.held = false
+	}
+}
@@ -0,0 +1,111 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+MaxRedirects is how many redirects in a row we'll follow before giving up.
+*/
+const MaxRedirects int = 10
+
+var (
+	// ErrRedirectLoop is returned when a redirect chain comes back round to
+	// somewhere it's already been.
+	ErrRedirectLoop = errors.New("redirect loop")
+	// ErrTooManyRedirects is returned when a redirect chain is longer than
+	// MaxRedirects.
+	ErrTooManyRedirects = errors.New("too many redirects")
+	// errRedirectNotFollowed is returned when Options.FollowRedirect turns a
+	// hop down. It never leaves the package, since stopping there isn't a
+	// failure.
+	errRedirectNotFollowed = errors.New("redirect not followed")
+)
+
+/*
+Redirect is one hop of a redirect chain: URL answered with StatusCode and
+sent us to Location.
+*/
+type Redirect struct {
+	URL        string
+	StatusCode int
+	Location   string
+}
+
+/*
+followRedirects is doWithRetries, but follows redirects itself rather than
+leaving it to client, so it can record every hop. Each hop gets its own
+retries. If the chain loops or is too long, it returns an error wrapping
+ErrRedirectLoop or ErrTooManyRedirects along with the hops up to then. If
+opts.FollowRedirect turns a hop down, it returns errRedirectNotFollowed with
+the hops up to and including that one, without fetching where it points.
+Every hop waits for slot to move to its host first, so a redirect to another
+host still keeps to that host's limits and crawl delay. slot can be nil.
+*/
+func followRedirects(ctx context.Context, client *http.Client, method string, link *url.URL, opts Options, slot *hostSlot) (*http.Response, []Redirect, time.Duration, error) {
+	// Copying the client is cheap, and the copy still shares its transport.
+	noFollow := *client
+	noFollow.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	var redirects []Redirect
+	seen := map[string]bool{link.String(): true}
+	for {
+		if err := slot.before(ctx, link); err != nil {
+			return nil, redirects, 0, err
+		}
+		resp, elapsed, err := doWithRetries(ctx, &noFollow, method, link, opts, slot)
+		if err != nil {
+			return nil, redirects, elapsed, err
+		}
+		location, ok := redirectLocation(resp)
+		if !ok {
+			return resp, redirects, elapsed, nil
+		}
+		// We don't care what a redirect says, only where it goes.
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		redirects = append(redirects, Redirect{URL: link.String(), StatusCode: resp.StatusCode, Location: location.String()})
+		if seen[location.String()] {
+			return nil, redirects, elapsed, fmt.Errorf("%w back to %s", ErrRedirectLoop, location)
+		}
+		if opts.FollowRedirect != nil && !opts.FollowRedirect(location) {
+			return nil, redirects, elapsed, errRedirectNotFollowed
+		}
+		if len(redirects) >= MaxRedirects {
+			return nil, redirects, elapsed, fmt.Errorf("%w, gave up after %d", ErrTooManyRedirects, len(redirects))
+		}
+		seen[location.String()] = true
+		link = location
+	}
+}
+
+/*
+redirectLocation returns where resp is redirecting us to, if it's a redirect
+we can follow.
+*/
+func redirectLocation(resp *http.Response) (*url.URL, bool) {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, false
+	}
+	header := resp.Header.Get("Location")
+	if header == "" {
+		return nil, false
+	}
+	location, err := resp.Request.URL.Parse(header)
+	if err != nil {
+		return nil, false
+	}
+	location.Fragment = ""
+	return location, true
+}
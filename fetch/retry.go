@@ -0,0 +1,139 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultRetries is how many times a failed request is retried if not
+	// told otherwise.
+	DefaultRetries int = 3
+	// DefaultRetryBaseDelay is the wait before the first retry, which then
+	// doubles with every attempt.
+	DefaultRetryBaseDelay time.Duration = 500 * time.Millisecond
+	// DefaultRetryMaxDelay is the longest we will ever wait between attempts.
+	DefaultRetryMaxDelay time.Duration = 30 * time.Second
+)
+
+/*
+StatusError is returned when a server keeps answering with a status code worth
+retrying (5xx or 429) until we give up.
+*/
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+/*
+doWithRetries makes a request for link, retrying network errors and
+5xx/429 responses up to opts.Retries times. Between attempts it waits for the
+server's Retry-After if it sent one, or a jittered exponential backoff if it
+didn't. If the server asks us to wait longer than opts.RetryMaxDelay, we give
+up instead. While it waits it gives up slot, and takes it back through the
+host's crawl delay like any other request. It also returns how long the last
+attempt took to respond. Cancelling ctx stops it straight away, mid request or
+mid wait, with ctx's error. slot can be nil.
+*/
+func doWithRetries(ctx context.Context, client *http.Client, method string, link *url.URL, opts Options, slot *hostSlot) (*http.Response, time.Duration, error) {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest(ctx, method, link, opts)
+		if err != nil {
+			// There's no point retrying a request we can't even build.
+			return nil, 0, err
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		elapsed := time.Since(start)
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			return resp, elapsed, nil
+		}
+		if ctx.Err() != nil {
+			// We were told to stop, so this isn't worth retrying.
+			return nil, elapsed, ctx.Err()
+		}
+
+		wait := backoff(attempt, opts)
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = &StatusError{StatusCode: resp.StatusCode}
+			if after, ok := retryAfter(resp); ok {
+				wait = after
+			}
+			// Drain the body so the connection can be reused for the retry.
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if attempt >= opts.Retries {
+			return nil, elapsed, fmt.Errorf("giving up after %d attempts: %w", attempt+1, lastErr)
+		}
+		if wait > opts.RetryMaxDelay {
+			return nil, elapsed, fmt.Errorf("giving up after %d attempts, server asked us to wait %s: %w", attempt+1, wait, lastErr)
+		}
+		if err := slot.pause(ctx, link, wait); err != nil {
+			return nil, elapsed, err
+		}
+	}
+}
+
+/*
+retryableStatus returns whether a response with this status code is worth
+asking for again.
+*/
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+/*
+backoff returns how long to wait before retry number attempt+1. It doubles
+opts.RetryBaseDelay each attempt up to opts.RetryMaxDelay, then picks a random
+point in the top half of that so a batch of failures doesn't retry in lockstep.
+*/
+func backoff(attempt int, opts Options) time.Duration {
+	delay := opts.RetryBaseDelay
+	for i := 0; i < attempt && delay < opts.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > opts.RetryMaxDelay {
+		delay = opts.RetryMaxDelay
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+/*
+retryAfter parses the Retry-After header, which is either a number of seconds
+or an HTTP date.
+*/
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		wait := time.Until(when)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,195 @@
+package fetch
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+/*
+LinkKind says what sort of thing a link is for, which depends on the tag it
+was found in.
+*/
+type LinkKind string
+
+const (
+	// KindNavigation is a link to another page: <a>, <area>, <iframe>,
+	// <frame>, and <link>s like rel="next" or rel="alternate".
+	KindNavigation LinkKind = "navigation"
+	// KindResource is something a page loads to display itself: images,
+	// scripts, stylesheets, icons, video, audio and the like.
+	KindResource LinkKind = "resource"
+	// KindForm is where a <form> submits to.
+	KindForm LinkKind = "form"
+	// KindRefresh is where a <meta http-equiv="refresh"> sends you.
+	KindRefresh LinkKind = "refresh"
+)
+
+/*
+DefaultLinkKinds is which kinds of link Links looks for if not told otherwise:
+the ones that lead to other pages.
+*/
+var DefaultLinkKinds = []LinkKind{KindNavigation, KindRefresh}
+
+/*
+DefaultLinkTags is which tags Links looks for links in if not told otherwise:
+every one it knows about. Which of the links it finds are kept still depends
+on their LinkKind.
+*/
+var DefaultLinkTags = []string{
+	"a", "area", "iframe", "frame", "link", "meta", "form",
+	"img", "script", "source", "video", "audio", "track", "embed",
+}
+
+/*
+resourceRels are the <link> rel values that point at something the page
+loads, rather than another page.
+*/
+var resourceRels = map[string]bool{
+	"stylesheet":       true,
+	"icon":             true,
+	"apple-touch-icon": true,
+	"manifest":         true,
+	"preload":          true,
+	"prefetch":         true,
+	"modulepreload":    true,
+	"preconnect":       true,
+	"dns-prefetch":     true,
+}
+
+/*
+foundLink is a link in a tag, before it's been parsed.
+*/
+type foundLink struct {
+	href string
+	kind LinkKind
+	rel  string
+	text string
+}
+
+/*
+linksInTag returns the links in a start tag, if it has any. Most tags have one
+at most, but an <img> or <source> can list a whole set of images in srcset.
+The text is only filled in where the tag itself has some, like an <area>'s
+alt. An <a>'s text is between its tags, so getLinksForSingleURL collects that
+itself.
+*/
+func linksInTag(t html.Token) []foundLink {
+	var found []foundLink
+	add := func(href string, kind LinkKind, rel string, text string) {
+		if href = strings.TrimSpace(href); href != "" {
+			found = append(found, foundLink{href: href, kind: kind, rel: rel, text: text})
+		}
+	}
+	switch t.Data {
+	case "a":
+		add(getHref(t), KindNavigation, getAttr(t, "rel"), "")
+	case "area":
+		add(getHref(t), KindNavigation, getAttr(t, "rel"), getAttr(t, "alt"))
+	case "iframe", "frame":
+		add(getAttr(t, "src"), KindNavigation, "", getAttr(t, "title"))
+	case "link":
+		rel := getAttr(t, "rel")
+		add(getHref(t), linkRelKind(rel), rel, getAttr(t, "title"))
+	case "img":
+		add(getAttr(t, "src"), KindResource, "", getAttr(t, "alt"))
+		for _, href := range srcsetURLs(getAttr(t, "srcset")) {
+			add(href, KindResource, "", getAttr(t, "alt"))
+		}
+	case "source":
+		// A <source> in a <picture> has a srcset, and one in a <video> or
+		// <audio> has a src.
+		add(getAttr(t, "src"), KindResource, "", "")
+		for _, href := range srcsetURLs(getAttr(t, "srcset")) {
+			add(href, KindResource, "", "")
+		}
+	case "video":
+		add(getAttr(t, "src"), KindResource, "", getAttr(t, "title"))
+		add(getAttr(t, "poster"), KindResource, "", getAttr(t, "title"))
+	case "audio", "track", "embed", "script":
+		add(getAttr(t, "src"), KindResource, "", "")
+	case "form":
+		add(getAttr(t, "action"), KindForm, "", "")
+	case "meta":
+		if strings.EqualFold(getAttr(t, "http-equiv"), "refresh") {
+			add(refreshURL(getAttr(t, "content")), KindRefresh, "", "")
+		}
+	}
+	return found
+}
+
+/*
+linkRelKind says whether a <link> with this rel is a resource or another page.
+rel can hold several space separated values, and any resource one makes it a
+resource.
+*/
+func linkRelKind(rel string) LinkKind {
+	for _, value := range strings.Fields(strings.ToLower(rel)) {
+		if resourceRels[value] {
+			return KindResource
+		}
+	}
+	return KindNavigation
+}
+
+/*
+srcsetURLs returns the URLs in a srcset, which is a comma separated list of
+URLs, each optionally followed by a descriptor like "2x" or "480w". URLs can
+have commas in them too, so only a comma after a space, or at the very end of
+the URL, separates two of them.
+*/
+func srcsetURLs(srcset string) []string {
+	var urls []string
+	rest := srcset
+	for {
+		rest = strings.TrimLeft(rest, " \t\n\r\f,")
+		if rest == "" {
+			return urls
+		}
+		end := strings.IndexAny(rest, " \t\n\r\f")
+		if end < 0 {
+			end = len(rest)
+		}
+		candidate := rest[:end]
+		rest = rest[end:]
+		if trimmed := strings.TrimRight(candidate, ","); trimmed != candidate {
+			// Commas straight after the URL end it, with no descriptor.
+			urls = append(urls, trimmed)
+			continue
+		}
+		urls = append(urls, candidate)
+		// Skip the descriptor, up to the comma that ends it.
+		if comma := strings.IndexByte(rest, ','); comma >= 0 {
+			rest = rest[comma+1:]
+		} else {
+			rest = ""
+		}
+	}
+}
+
+/*
+refreshURL pulls the URL out of a meta refresh's content, which looks like
+"5; url=/somewhere" (the url= and quotes are optional). It returns the empty
+string if there isn't one, which means the page just reloads itself.
+*/
+func refreshURL(content string) string {
+	sep := strings.IndexAny(content, ";,")
+	if sep < 0 {
+		return ""
+	}
+	target := strings.TrimSpace(content[sep+1:])
+	if len(target) >= 3 && strings.EqualFold(target[:3], "url") {
+		rest := strings.TrimSpace(target[3:])
+		if strings.HasPrefix(rest, "=") {
+			target = strings.TrimSpace(rest[1:])
+		}
+	}
+	if len(target) > 0 && (target[0] == '\'' || target[0] == '"') {
+		if end := strings.IndexByte(target[1:], target[0]); end >= 0 {
+			target = target[1 : end+1]
+		} else {
+			target = target[1:]
+		}
+	}
+	return target
+}
@@ -0,0 +1,116 @@
+package fetch
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+/*
+firstTag returns the first start tag in fragment.
+*/
+func firstTag(t *testing.T, fragment string) html.Token {
+	z := html.NewTokenizer(strings.NewReader(fragment))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			t.Fatalf("No start tag in %s", fragment)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			return z.Token()
+		}
+	}
+}
+
+func TestLinksInTag(t *testing.T) {
+	cases := []struct {
+		tag  string
+		href string
+		kind LinkKind
+	}{
+		{`<a href="/a">`, "/a", KindNavigation},
+		{`<area href="/map" alt="Map">`, "/map", KindNavigation},
+		{`<iframe src="/frame">`, "/frame", KindNavigation},
+		{`<frame src="/frame">`, "/frame", KindNavigation},
+		{`<link rel="next" href="/page/2">`, "/page/2", KindNavigation},
+		{`<link rel="stylesheet" href="/style.css">`, "/style.css", KindResource},
+		{`<link rel="shortcut icon" href="/favicon.ico">`, "/favicon.ico", KindResource},
+		{`<link rel="preconnect" href="https://fonts.example">`, "https://fonts.example", KindResource},
+		{`<link rel="dns-prefetch" href="//cdn.example">`, "//cdn.example", KindResource},
+		{`<img src="/cat.png">`, "/cat.png", KindResource},
+		{`<script src="/app.js">`, "/app.js", KindResource},
+		{`<source src="/clip.webm">`, "/clip.webm", KindResource},
+		{`<audio src="/song.ogg">`, "/song.ogg", KindResource},
+		{`<track src="/subs.vtt">`, "/subs.vtt", KindResource},
+		{`<embed src="/movie.swf">`, "/movie.swf", KindResource},
+		{`<form action="/search">`, "/search", KindForm},
+		{`<meta http-equiv="Refresh" content="0; url=/moved">`, "/moved", KindRefresh},
+	}
+	for _, c := range cases {
+		found := linksInTag(firstTag(t, c.tag))
+		if len(found) != 1 || found[0].href != c.href || found[0].kind != c.kind {
+			t.Errorf("Expected %s to give %s (%s), got %+v", c.tag, c.href, c.kind, found)
+		}
+	}
+	for _, tag := range []string{`<a name="top">`, `<script>`, `<meta http-equiv="refresh" content="30">`, `<p>`} {
+		if found := linksInTag(firstTag(t, tag)); len(found) != 0 {
+			t.Errorf("Expected %s to have no links, got %+v", tag, found)
+		}
+	}
+}
+
+func TestLinksInTagSets(t *testing.T) {
+	cases := map[string][]string{
+		`<img src="/cat.png" srcset="/cat-2x.png 2x, /cat-3x.png 3x">`: {"/cat.png", "/cat-2x.png", "/cat-3x.png"},
+		`<source srcset="/wide.jpg 800w,/narrow.jpg 400w">`:            {"/wide.jpg", "/narrow.jpg"},
+		`<video src="/clip.mp4" poster="/still.jpg">`:                  {"/clip.mp4", "/still.jpg"},
+	}
+	for tag, expected := range cases {
+		found := linksInTag(firstTag(t, tag))
+		if len(found) != len(expected) {
+			t.Errorf("Expected %s to give %v, got %+v", tag, expected, found)
+			continue
+		}
+		for i := range expected {
+			if found[i].href != expected[i] || found[i].kind != KindResource {
+				t.Errorf("Expected %s to give %v, got %+v", tag, expected, found)
+				break
+			}
+		}
+	}
+}
+
+func TestSrcsetURLs(t *testing.T) {
+	cases := map[string][]string{
+		"/a.png":                      {"/a.png"},
+		"/a.png 1x, /b.png 2x":        {"/a.png", "/b.png"},
+		"/a.png,/b.png":               {"/a.png,/b.png"},
+		"/a.png, /b.png":              {"/a.png", "/b.png"},
+		"/a,b.png 1x,/c.png 2x":       {"/a,b.png", "/c.png"},
+		"  /a.png   480w ,\n /b.png ": {"/a.png", "/b.png"},
+		"":                            nil,
+	}
+	for srcset, expected := range cases {
+		actual := srcsetURLs(srcset)
+		if strings.Join(actual, " ") != strings.Join(expected, " ") || len(actual) != len(expected) {
+			t.Errorf("Expected %q to give %q, got %q", srcset, expected, actual)
+		}
+	}
+}
+
+func TestRefreshURL(t *testing.T) {
+	cases := map[string]string{
+		"0; url=/moved":         "/moved",
+		"5;URL='/quoted'":       "/quoted",
+		`0; url="/dq"`:          "/dq",
+		"3, /no-url-prefix":     "/no-url-prefix",
+		"0;url = /spaced ":      "/spaced",
+		"10":                    "",
+		"0; url=/unterminated'": "/unterminated'",
+	}
+	for content, expected := range cases {
+		if actual := refreshURL(content); actual != expected {
+			t.Errorf("Expected %q to give %q, got %q", content, expected, actual)
+		}
+	}
+}
@@ -1,17 +1,444 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/kn100/charlotte/fetch"
 	"github.com/kn100/charlotte/sitemap"
+	"github.com/kn100/charlotte/util"
 )
 
+/*
+Exit codes. Anything other than exitOK means the output (if there is any)
+shouldn't be trusted to be complete.
+*/
+const (
+	// exitOK means every seed was crawled and nothing was broken.
+	exitOK = 0
+	// exitBrokenLinks means the crawl finished, but some pages couldn't be
+	// loaded or returned a 4xx/5xx.
+	exitBrokenLinks = 1
+	// exitUsage means the flags didn't make sense.
+	exitUsage = 2
+	// exitFailed means a seed couldn't be crawled at all, or the output
+	// couldn't be written.
+	exitFailed = 3
+	// exitInterrupted means we were told to stop part way through. Whatever
+	// had been crawled by then is still written out.
+	exitInterrupted = 4
+)
+
+/*
+stringList collects every use of a flag that can be given more than once.
+*/
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+/*
+config is everything the flags tell us.
+*/
+type config struct {
+	seeds        []string
+	depth        int
+	timeout      time.Duration
+	maxPages     int
+	maxBytes     int64
+	maxTime      time.Duration
+	fetch        fetch.Options
+	links        string
+	linkTags     string
+	normalizer   util.Normalizer
+	stripParams  string
+	slashes      string
+	schemes      string
+	format       string
+	xml          sitemap.XMLOptions
+	dot          sitemap.DOTOptions
+	output       string
+	ignoreRobots bool
+	sitemaps     bool
+	scope        string
+	subdomains   string
+	allow        string
+	prefix       string
+	include      []string
+	exclude      []string
+}
+
 func main() {
-	fmt.Println("Generating sitemap")
-	timeout := time.Duration(10 * time.Second)
-	sm := sitemap.MakeSiteMap("https://kn100.me/", 5, timeout)
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+/*
+run does everything main does, but returns the exit code rather than exiting.
+The output goes to stdout unless -o says otherwise, and everything else,
+including whatever the crawl logs, goes to stderr, so stdout is always safe to
+pipe into something else.
+*/
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	cfg, err := parseFlags(args, stderr)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	cfg.fetch.Logger = log.New(stderr, "", log.LstdFlags)
+
+	out := stdout
+	if cfg.output != "" {
+		f, err := os.Create(cfg.output)
+		if err != nil {
+			fmt.Fprintf(stderr, "Couldn't create %s. Err: %s\n", cfg.output, err)
+			return exitFailed
+		}
+		defer f.Close()
+		out = f
+	}
+
+	// Ctrl-C stops the crawl, but we still write out what we found so far.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	code := exitOK
+	for i, seed := range cfg.seeds {
+		if ctx.Err() != nil {
+			// Don't start on any more seeds once we've been told to stop.
+			break
+		}
+		fmt.Fprintf(stderr, "Generating sitemap for %s\n", seed)
+		sm, err := crawl(ctx, cfg, seed)
+		if sm == nil {
+			fmt.Fprintln(stderr, err)
+			code = exitFailed
+			continue
+		}
+		var seedErr *sitemap.SeedFetchError
+		var skippedErr *sitemap.SeedSkippedError
+		if errors.As(err, &seedErr) || errors.As(err, &skippedErr) {
+			// There's still a sitemap to show, it's just a short one.
+			fmt.Fprintln(stderr, err)
+			code = exitFailed
+		}
+		if len(sm.BrokenLinks()) > 0 && code == exitOK {
+			code = exitBrokenLinks
+		}
+		if cfg.format == "xml" {
+			if err := writeXML(out, stderr, sm, cfg); err != nil {
+				fmt.Fprintf(stderr, "Couldn't write output. Err: %s\n", err)
+				return exitFailed
+			}
+			continue
+		}
+		if i > 0 && cfg.format != "json" {
+			fmt.Fprintln(out)
+		}
+		rendered := strings.TrimSuffix(render(sm, cfg), "\n") + "\n"
+		if _, err := io.WriteString(out, rendered); err != nil {
+			fmt.Fprintf(stderr, "Couldn't write output. Err: %s\n", err)
+			return exitFailed
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(stderr, "Interrupted, the output is incomplete.")
+		return exitInterrupted
+	}
+	return code
+}
+
+/*
+parseFlags turns the command line into a config. Seeds can be given with
+-seed, as plain arguments, or both. Usage and flag errors are written to
+output.
+*/
+func parseFlags(args []string, output io.Writer) (config, error) {
+	cfg := config{fetch: fetch.DefaultOptions(), normalizer: util.DefaultNormalizer()}
+	var collapseIndex bool
+	var seeds, headers, include, exclude stringList
+	flags := flag.NewFlagSet("charlotte", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: charlotte [flags] [seed URL...]\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Var(&seeds, "seed", "URL to start crawling from (can be given more than once)")
+	flags.IntVar(&cfg.depth, "depth", sitemap.DefaultDepth, "how many links deep to crawl")
+	flags.DurationVar(&cfg.timeout, "timeout", sitemap.DefaultTimeout, "timeout for each HTTP request")
+	flags.IntVar(&cfg.maxPages, "max-pages", 0, "stop after fetching this many pages (0 means no limit)")
+	flags.Int64Var(&cfg.maxBytes, "max-bytes", 0, "stop after downloading this many bytes (0 means no limit)")
+	flags.DurationVar(&cfg.maxTime, "max-time", 0, "stop after crawling each seed for this long (0 means no limit)")
+	flags.IntVar(&cfg.fetch.Concurrency, "concurrency", fetch.DefaultConcurrency, "maximum requests in flight at once")
+	flags.IntVar(&cfg.fetch.PerHostConcurrency, "per-host", fetch.DefaultPerHostConcurrency, "maximum requests in flight against one host")
+	flags.IntVar(&cfg.fetch.Retries, "retries", fetch.DefaultRetries, "how many times to retry a failed request")
+	flags.StringVar(&cfg.fetch.UserAgent, "user-agent", fetch.DefaultUserAgent, "User-Agent to send with every request")
+	flags.Int64Var(&cfg.fetch.MaxBodySize, "max-body", fetch.DefaultMaxBodySize, "most bytes of a page to read looking for links")
+	flags.Var(&headers, "header", "extra header to send with every request, as 'Name: value' (can be given more than once)")
+	flags.StringVar(&cfg.scope, "scope", "site", "which links to follow: site (the whole domain), host (the seed's host only), subdomains (the seed's host plus -subdomains) or allowlist (the -allow domains)")
+	flags.StringVar(&cfg.subdomains, "subdomains", "", "comma separated subdomains of the seed's host to follow, for -scope subdomains")
+	flags.StringVar(&cfg.allow, "allow", "", "comma separated domains to follow, for -scope allowlist")
+	flags.StringVar(&cfg.prefix, "prefix", "", "only follow links whose path starts with this")
+	flags.Var(&include, "include", "only follow URLs matching this regular expression (can be given more than once)")
+	flags.Var(&exclude, "exclude", "never follow URLs matching this regular expression (can be given more than once)")
+	flags.StringVar(&cfg.links, "links", "navigation,refresh", "comma separated kinds of link to follow: navigation, refresh, form and resource")
+	flags.StringVar(&cfg.linkTags, "link-tags", "", "comma separated tags to look for links in, like a,iframe (default every tag it knows)")
+	flags.BoolVar(&cfg.normalizer.StripQuery, "strip-query", false, "treat URLs that only differ in their query string as the same page")
+	flags.StringVar(&cfg.stripParams, "strip-params", strings.Join(util.DefaultTrackingParams, ","), "comma separated query parameters to drop from URLs, where a trailing * matches any ending")
+	flags.StringVar(&cfg.slashes, "trailing-slash", "keep", "what to do with a slash on the end of a path: keep, add or remove")
+	flags.StringVar(&cfg.schemes, "schemes", "merge", "whether http and https URLs are the same page: keep (no), merge (yes, crawl whichever is found first) or https (yes, always crawl over https)")
+	flags.BoolVar(&collapseIndex, "collapse-index", false, "treat /dir/index.html as the same page as /dir/")
+	flags.StringVar(&cfg.format, "format", "tree", "output format: tree, json, xml, dot, broken, redirects, insecure or listed")
+	flags.BoolVar(&cfg.xml.Priority, "priority", false, "with -format xml, give every page a priority based on how far it is from the seed")
+	flags.BoolVar(&cfg.xml.Gzip, "gzip", false, "with -format xml, gzip the sitemap")
+	flags.StringVar(&cfg.xml.BaseURL, "xml-base", "", "with -format xml, the URL the sitemap files will be served from, and only pages on its host are listed (default the root of the site)")
+	flags.StringVar((*string)(&cfg.dot.Cluster), "cluster", string(sitemap.ClusterByHost), "with -format dot, how to group the pages: host, depth or none")
+	flags.StringVar(&cfg.output, "o", "", "file to write output to (default stdout)")
+	flags.BoolVar(&cfg.sitemaps, "sitemaps", false, "also crawl every page listed in the site's sitemap.xml files")
+	flags.BoolVar(&cfg.ignoreRobots, "ignore-robots", false, "don't read robots.txt (only for domains that have agreed to it!)")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	cfg.seeds = append(seeds, flags.Args()...)
+	cfg.include = include
+	cfg.exclude = exclude
+	if len(cfg.seeds) == 0 {
+		flags.Usage()
+		return cfg, fmt.Errorf("at least one seed URL is needed")
+	}
+	switch cfg.format {
+	case "tree", "json", "xml", "dot", "broken", "redirects", "insecure", "listed":
+	default:
+		return cfg, fmt.Errorf("unknown format %q, expected tree, json, xml, dot, broken, redirects, insecure or listed", cfg.format)
+	}
+	switch cfg.dot.Cluster {
+	case sitemap.ClusterByHost, sitemap.ClusterByDepth, sitemap.ClusterNone:
+	default:
+		return cfg, fmt.Errorf("unknown cluster %q, expected host, depth or none", cfg.dot.Cluster)
+	}
+	if cfg.format == "xml" && len(cfg.seeds) > 1 {
+		return cfg, fmt.Errorf("-format xml only works with one seed")
+	}
+	if cfg.output != "" {
+		// Split sitemaps are named after the file they're split from.
+		name := filepath.Base(cfg.output)
+		name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".xml")
+		cfg.xml.Name = name
+	}
+	switch cfg.scope {
+	case "site", "host", "subdomains", "allowlist":
+	default:
+		return cfg, fmt.Errorf("unknown scope %q, expected site, host, subdomains or allowlist", cfg.scope)
+	}
+	if cfg.scope == "allowlist" && cfg.allow == "" {
+		return cfg, fmt.Errorf("-scope allowlist needs -allow")
+	}
+	if _, err := util.NewRegexScope(cfg.include, cfg.exclude); err != nil {
+		return cfg, err
+	}
+	if cfg.depth < 0 {
+		return cfg, fmt.Errorf("depth can't be negative")
+	}
+	if cfg.maxPages < 0 || cfg.maxBytes < 0 || cfg.maxTime < 0 {
+		return cfg, fmt.Errorf("max-pages, max-bytes and max-time can't be negative")
+	}
+	for _, kind := range splitList(cfg.links) {
+		switch fetch.LinkKind(kind) {
+		case fetch.KindNavigation, fetch.KindRefresh, fetch.KindForm, fetch.KindResource:
+			cfg.fetch.LinkKinds = append(cfg.fetch.LinkKinds, fetch.LinkKind(kind))
+		default:
+			return cfg, fmt.Errorf("unknown kind of link %q, expected navigation, refresh, form or resource", kind)
+		}
+	}
+	known := make(map[string]bool)
+	for _, tag := range fetch.DefaultLinkTags {
+		known[tag] = true
+	}
+	for _, tag := range splitList(cfg.linkTags) {
+		tag = strings.ToLower(tag)
+		if !known[tag] {
+			return cfg, fmt.Errorf("unknown tag %q, expected one of %s", tag, strings.Join(fetch.DefaultLinkTags, ", "))
+		}
+		cfg.fetch.LinkTags = append(cfg.fetch.LinkTags, tag)
+	}
+	switch cfg.slashes {
+	case "keep":
+		cfg.normalizer.TrailingSlash = util.KeepTrailingSlash
+	case "add":
+		cfg.normalizer.TrailingSlash = util.AddTrailingSlash
+	case "remove":
+		cfg.normalizer.TrailingSlash = util.RemoveTrailingSlash
+	default:
+		return cfg, fmt.Errorf("unknown trailing-slash %q, expected keep, add or remove", cfg.slashes)
+	}
+	switch cfg.schemes {
+	case "keep":
+		cfg.normalizer.Schemes = util.KeepSchemes
+	case "merge":
+		cfg.normalizer.Schemes = util.MergeSchemes
+	case "https":
+		cfg.normalizer.Schemes = util.PreferHTTPS
+	default:
+		return cfg, fmt.Errorf("unknown schemes %q, expected keep, merge or https", cfg.schemes)
+	}
+	cfg.normalizer.StripParams = splitList(cfg.stripParams)
+	if collapseIndex {
+		cfg.normalizer.IndexFiles = util.DefaultIndexFiles
+	}
+	if cfg.fetch.MaxBodySize < 1 {
+		return cfg, fmt.Errorf("max-body must be at least 1")
+	}
+	if cfg.fetch.Retries < 0 {
+		return cfg, fmt.Errorf("retries can't be negative")
+	}
+	cfg.fetch.NoRetries = cfg.fetch.Retries == 0
+	cfg.fetch.Headers = make(http.Header)
+	for _, header := range headers {
+		colon := strings.IndexByte(header, ':')
+		if colon < 1 {
+			return cfg, fmt.Errorf("header %q should look like 'Name: value'", header)
+		}
+		cfg.fetch.Headers.Add(strings.TrimSpace(header[:colon]), strings.TrimSpace(header[colon+1:]))
+	}
+	return cfg, nil
+}
+
+/*
+crawl builds the sitemap for one seed. The sitemap is nil if the seed couldn't
+be crawled at all, and the error says why. If ctx is cancelled part way
+through, it returns what it found up to then.
+*/
+func crawl(ctx context.Context, cfg config, seed string) (*sitemap.SiteMap, error) {
+	var scope util.Scope
+	if seedURL, err := url.Parse(seed); err == nil {
+		scope = buildScope(cfg, seedURL)
+	}
+	crawler := sitemap.NewCrawler(
+		sitemap.WithDepth(cfg.depth),
+		sitemap.WithTimeout(cfg.timeout),
+		sitemap.WithMaxPages(cfg.maxPages),
+		sitemap.WithMaxBytes(cfg.maxBytes),
+		sitemap.WithMaxDuration(cfg.maxTime),
+		sitemap.WithFetchOptions(cfg.fetch),
+		sitemap.WithIgnoreRobots(cfg.ignoreRobots),
+		sitemap.WithSitemapSeeds(cfg.sitemaps),
+		sitemap.WithScope(scope),
+		sitemap.WithNormalizer(cfg.normalizer),
+	)
+	return crawler.Crawl(ctx, seed)
+}
+
+/*
+buildScope puts together the scope the flags asked for. A nil scope means the
+default, which is the whole site. The flags were checked by parseFlags, so
+this can't fail.
+*/
+func buildScope(cfg config, seedURL *url.URL) util.Scope {
+	var scopes util.AllScopes
+	switch cfg.scope {
+	case "host":
+		scopes = append(scopes, util.NewExactHostScope(seedURL))
+	case "subdomains":
+		scopes = append(scopes, util.SubdomainScope{Host: seedURL.Hostname(), Subdomains: splitList(cfg.subdomains)})
+	case "allowlist":
+		scopes = append(scopes, util.AllowlistScope{Domains: splitList(cfg.allow)})
+	default:
+		siteScope, err := util.NewSameSiteScope(seedURL)
+		if err != nil {
+			// Crawl will complain about this in a moment.
+			return nil
+		}
+		scopes = append(scopes, siteScope)
+	}
+	if cfg.prefix != "" {
+		scopes = append(scopes, util.PathPrefixScope{Prefix: cfg.prefix})
+	}
+	if len(cfg.include) > 0 || len(cfg.exclude) > 0 {
+		regexScope, _ := util.NewRegexScope(cfg.include, cfg.exclude)
+		scopes = append(scopes, regexScope)
+	}
+	return scopes
+}
+
+/*
+splitList splits a comma separated flag value, dropping empty entries.
+*/
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/*
+writeXML writes the sitemap to out as sitemap.xml. If it's too big for one
+file, out gets the sitemap index, and the files it points to are written next
+to the output file (or in the current directory, if the output is stdout).
+*/
+func writeXML(out io.Writer, stderr io.Writer, sm *sitemap.SiteMap, cfg config) error {
+	files, err := sm.XMLSitemaps(cfg.xml)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(files[0].Data); err != nil {
+		return err
+	}
+	dir := "."
+	if cfg.output != "" {
+		dir = filepath.Dir(cfg.output)
+	}
+	for _, file := range files[1:] {
+		path := filepath.Join(dir, file.Name)
+		if err := os.WriteFile(path, file.Data, 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(stderr, "Wrote %s\n", path)
+	}
+	return nil
+}
 
-	fmt.Println(sm.String())
-	//fmt.Println(sm.JSON())
+/*
+render returns the sitemap in the requested format.
+*/
+func render(sm *sitemap.SiteMap, cfg config) string {
+	switch cfg.format {
+	case "json":
+		return sm.JSON()
+	case "dot":
+		return sm.DOT(cfg.dot)
+	case "broken":
+		return sm.BrokenLinksReport()
+	case "redirects":
+		return sm.RedirectsReport()
+	case "insecure":
+		return sm.InsecureLinksReport()
+	case "listed":
+		return sm.ListedPagesReport()
+	default:
+		return sm.String()
+	}
 }
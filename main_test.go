@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kn100/charlotte/fetch"
+	"github.com/kn100/charlotte/util"
+)
+
+/*
+testSite serves a small site. The home page links to /about, to a few things
+that aren't web pages at all, and to /gone if broken is set, which 404s.
+/about drops the connection part way through if cutShort is set.
+*/
+func testSite(broken bool, cutShort bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="/about">About</a>
+<a href="mailto:kevin@kn100.me">Email</a>
+<a href="tel:+441234567890">Phone</a>
+<a href="javascript:void(0)">Menu</a>`)
+			if broken {
+				fmt.Fprint(w, `<a href="/gone">Gone</a>`)
+			}
+		case "/about":
+			w.Header().Set("Content-Type", "text/html")
+			if cutShort {
+				w.Header().Set("Content-Length", "1000")
+			}
+			fmt.Fprint(w, `<a href="/">Home</a>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestParseFlags(t *testing.T) {
+	cases := []struct {
+		name  string
+		args  []string
+		err   bool
+		check func(cfg config) bool
+	}{
+		{"no seeds", []string{}, true, nil},
+		{"help", []string{"-h"}, true, nil},
+		{"unknown flag", []string{"-nope", "https://kn100.me/"}, true, nil},
+		{"defaults", []string{"https://kn100.me/"}, false, func(cfg config) bool {
+			return cfg.format == "tree" && cfg.scope == "site" && cfg.normalizer.Schemes == util.MergeSchemes && len(cfg.fetch.LinkKinds) == 2
+		}},
+		{"seeds from flags and arguments", []string{"-seed", "https://kn100.me/", "https://monzo.com/"}, false, func(cfg config) bool {
+			return len(cfg.seeds) == 2 && cfg.seeds[0] == "https://kn100.me/"
+		}},
+		{"unknown format", []string{"-format", "yaml", "https://kn100.me/"}, true, nil},
+		{"unknown scope", []string{"-scope", "planet", "https://kn100.me/"}, true, nil},
+		{"allowlist without -allow", []string{"-scope", "allowlist", "https://kn100.me/"}, true, nil},
+		{"bad regexp", []string{"-include", "(", "https://kn100.me/"}, true, nil},
+		{"negative depth", []string{"-depth", "-1", "https://kn100.me/"}, true, nil},
+		{"negative budget", []string{"-max-pages", "-1", "https://kn100.me/"}, true, nil},
+		{"unknown link kind", []string{"-links", "navigation,carrier-pigeon", "https://kn100.me/"}, true, nil},
+		{"unknown link tag", []string{"-link-tags", "a,blink", "https://kn100.me/"}, true, nil},
+		{"link tags", []string{"-link-tags", "A, iframe", "https://kn100.me/"}, false, func(cfg config) bool {
+			return len(cfg.fetch.LinkTags) == 2 && cfg.fetch.LinkTags[0] == "a"
+		}},
+		{"link kinds", []string{"-links", "navigation, resource", "https://kn100.me/"}, false, func(cfg config) bool {
+			return len(cfg.fetch.LinkKinds) == 2 && cfg.fetch.LinkKinds[1] == fetch.KindResource
+		}},
+		{"zero max body", []string{"-max-body", "0", "https://kn100.me/"}, true, nil},
+		{"negative retries", []string{"-retries", "-1", "https://kn100.me/"}, true, nil},
+		{"bad header", []string{"-header", "nocolon", "https://kn100.me/"}, true, nil},
+		{"headers", []string{"-header", "X-Test: yes", "-header", "X-Test: again", "https://kn100.me/"}, false, func(cfg config) bool {
+			return len(cfg.fetch.Headers.Values("X-Test")) == 2
+		}},
+		{"unknown trailing slash", []string{"-trailing-slash", "sometimes", "https://kn100.me/"}, true, nil},
+		{"normalization", []string{"-trailing-slash", "add", "-strip-query", "-collapse-index", "-strip-params", "ref", "https://kn100.me/"}, false, func(cfg config) bool {
+			n := cfg.normalizer
+			return n.TrailingSlash == util.AddTrailingSlash && n.StripQuery && len(n.IndexFiles) > 0 && len(n.StripParams) == 1
+		}},
+		{"unknown schemes", []string{"-schemes", "ftp", "https://kn100.me/"}, true, nil},
+		{"https", []string{"-schemes", "https", "https://kn100.me/"}, false, func(cfg config) bool {
+			return cfg.normalizer.Schemes == util.PreferHTTPS
+		}},
+		{"xml with two seeds", []string{"-format", "xml", "https://kn100.me/", "https://monzo.com/"}, true, nil},
+		{"xml named after output", []string{"-format", "xml", "-o", "/tmp/pages.xml.gz", "https://kn100.me/"}, false, func(cfg config) bool {
+			return cfg.xml.Name == "pages"
+		}},
+		{"unknown cluster", []string{"-format", "dot", "-cluster", "colour", "https://kn100.me/"}, true, nil},
+	}
+	for _, c := range cases {
+		cfg, err := parseFlags(c.args, io.Discard)
+		if (err != nil) != c.err {
+			t.Errorf("%s: expected error %t, got %v", c.name, c.err, err)
+			continue
+		}
+		if c.check != nil && !c.check(cfg) {
+			t.Errorf("%s: unexpected config %+v", c.name, cfg)
+		}
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	fine := testSite(false, false)
+	defer fine.Close()
+	broken := testSite(true, false)
+	defer broken.Close()
+	cutShort := testSite(false, true)
+	defer cutShort.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	cases := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"help", []string{"-h"}, exitOK},
+		{"bad flags", []string{"-format", "yaml", fine.URL}, exitUsage},
+		{"fine", []string{"-depth", "2", fine.URL}, exitOK},
+		{"broken links", []string{"-depth", "2", broken.URL}, exitBrokenLinks},
+		{"page cut short", []string{"-depth", "2", cutShort.URL}, exitOK},
+		{"bad seed", []string{"::not a url"}, exitFailed},
+		{"seed can't be fetched", []string{"-retries", "0", "-ignore-robots", downURL}, exitFailed},
+		{"seed's robots.txt can't be fetched", []string{"-retries", "0", downURL}, exitFailed},
+		{"unwritable output", []string{"-o", "/nonexistent/dir/out.txt", fine.URL}, exitFailed},
+	}
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		if code := run(c.args, &stdout, &stderr); code != c.code {
+			t.Errorf("%s: expected exit code %d, got %d. Stderr:\n%s", c.name, c.code, code, stderr.String())
+		}
+	}
+}
+
+/*
+runCapturingStdout calls run with the real os.Stdout swapped for a pipe, so
+anything that writes to stdout behind run's back ends up in the output too.
+*/
+func runCapturingStdout(t *testing.T, args []string, stderr io.Writer) (int, string) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Couldn't make a pipe: %s", err)
+	}
+	realStdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = realStdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+	code := run(args, os.Stdout, stderr)
+	writer.Close()
+	return code, <-output
+}
+
+func TestRunStdoutIsParseable(t *testing.T) {
+	ts := testSite(false, false)
+	defer ts.Close()
+
+	parsers := map[string]func(output string) error{
+		"json": func(output string) error {
+			var decoded map[string]interface{}
+			return json.Unmarshal([]byte(output), &decoded)
+		},
+		"xml": func(output string) error {
+			var decoded struct {
+				XMLName xml.Name `xml:"urlset"`
+			}
+			return xml.Unmarshal([]byte(output), &decoded)
+		},
+		"dot": func(output string) error {
+			if !strings.HasPrefix(output, "digraph sitemap {\n") || !strings.HasSuffix(output, "}\n") {
+				return fmt.Errorf("not a digraph")
+			}
+			return nil
+		},
+	}
+	for format, parse := range parsers {
+		var stderr bytes.Buffer
+		code, stdout := runCapturingStdout(t, []string{"-depth", "2", "-format", format, ts.URL}, &stderr)
+		if code != exitOK {
+			t.Errorf("%s: expected exit code %d, got %d. Stderr:\n%s", format, exitOK, code, stderr.String())
+		}
+		if err := parse(stdout); err != nil {
+			t.Errorf("%s: stdout didn't parse (%s):\n%s", format, err, stdout)
+		}
+		if strings.Contains(stdout, "mailto:") || strings.Contains(stdout, "javascript:") {
+			t.Errorf("%s: links that aren't http(s) shouldn't be in the output:\n%s", format, stdout)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package robots
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+Cache fetches robots.txt once per scheme and host and keeps the result for
+the lifetime of the Cache, which is intended to be a single crawl. Header is
+sent with every robots.txt request, so set the crawler's User-Agent in it.
+Problems fetching robots.txt are reported to Logger, which NewCache sets to the
+standard logger. mu only guards files, and is never held while we wait on a server,
+so one slow host can't hold up every other one.
+*/
+type Cache struct {
+	Header http.Header
+	Logger *log.Logger
+	client *http.Client
+	agent  string
+	mu     sync.Mutex
+	files  map[string]*cacheEntry
+}
+
+/*
+cacheEntry is one host's robots.txt. It goes in the Cache as soon as someone
+starts fetching it, so anyone else who wants it waits for done to be closed
+rather than fetching it again. robots is only set once done is closed, and is
+nil if the fetch was cancelled.
+*/
+type cacheEntry struct {
+	done   chan struct{}
+	robots *Robots
+}
+
+/*
+NewCache returns a Cache that fetches with client and checks rules for agent,
+which is a product token like the ones AgentToken returns.
+*/
+func NewCache(client *http.Client, agent string) *Cache {
+	return &Cache{
+		Logger: log.Default(),
+		client: client,
+		agent:  agent,
+		files:  make(map[string]*cacheEntry),
+	}
+}
+
+/*
+Get returns the robots.txt that applies to link, fetching it if we haven't
+already. If somebody else is already fetching it, Get waits for them instead.
+If ctx is cancelled before we get it, everything is disallowed, but that isn't
+remembered, so the next Get tries again.
+*/
+func (c *Cache) Get(ctx context.Context, link *url.URL) *Robots {
+	key := link.Scheme + "://" + link.Host
+	for {
+		c.mu.Lock()
+		entry, ok := c.files[key]
+		if !ok {
+			entry = &cacheEntry{done: make(chan struct{})}
+			c.files[key] = entry
+			c.mu.Unlock()
+			return c.fill(ctx, key, entry)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return Unavailable()
+		}
+		if entry.robots != nil {
+			return entry.robots
+		}
+		// Whoever was fetching it was cancelled, so it's our turn.
+	}
+}
+
+/*
+fill fetches the robots.txt for key into entry, which must already be in
+c.files, and tells anyone waiting on it that it's ready. A cancelled fetch is
+taken back out of c.files, so it can be tried again.
+*/
+func (c *Cache) fill(ctx context.Context, key string, entry *cacheEntry) *Robots {
+	robots := c.fetch(ctx, key+"/robots.txt")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(entry.done)
+	if ctx.Err() != nil {
+		delete(c.files, key)
+		return Unavailable()
+	}
+	entry.robots = robots
+	return robots
+}
+
+/*
+Prefetch fetches the robots.txt for every host in links that we don't have
+yet, up to workers of them at once, and returns once they're all done. It's
+the same as calling Get for each of them, only quicker.
+*/
+func (c *Cache) Prefetch(ctx context.Context, links []*url.URL, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	seen := make(map[string]bool)
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, link := range links {
+		key := link.Scheme + "://" + link.Host
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		wg.Add(1)
+		go func(link *url.URL) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			c.Get(ctx, link)
+			<-slots
+		}(link)
+	}
+	wg.Wait()
+}
+
+/*
+Check returns whether our agent may fetch link, and a human readable reason if
+it may not.
+*/
+func (c *Cache) Check(ctx context.Context, link *url.URL) (bool, string) {
+	allowed, rule := c.Get(ctx, link).Check(c.agent, link)
+	if allowed {
+		return true, ""
+	}
+	return false, fmt.Sprintf("disallowed by robots.txt (%s)", rule)
+}
+
+/*
+CrawlDelay returns the Crawl-delay that applies to link's host. It never
+fetches anything, or waits for anything being fetched, so it is zero if the
+host's robots.txt hasn't been fetched yet.
+*/
+func (c *Cache) CrawlDelay(link *url.URL) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.files[link.Scheme+"://"+link.Host]
+	if !ok || entry.robots == nil {
+		return 0
+	}
+	return entry.robots.CrawlDelay(c.agent)
+}
+
+/*
+fetch requests a robots.txt file. Following RFC 9309, a 4xx means there are no
+rules, and a 5xx or a failed request means we must assume everything is
+disallowed.
+*/
+func (c *Cache) fetch(ctx context.Context, robotsURL string) *Robots {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+	if err != nil {
+		c.Logger.Printf("Couldn't build a request for %s, so assuming everything is disallowed. Err: %s\n", robotsURL, err)
+		return Unavailable()
+	}
+	for key, values := range c.Header {
+		req.Header[key] = values
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.Logger.Printf("Couldn't fetch %s, so assuming everything is disallowed. Err: %s\n", robotsURL, err)
+		return Unavailable()
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return Parse(resp.Body)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return &Robots{}
+	default:
+		c.Logger.Printf("Got status %d for %s, so assuming everything is disallowed.\n", resp.StatusCode, robotsURL)
+		return Unavailable()
+	}
+}
@@ -0,0 +1,253 @@
+// Package robots parses robots.txt files and answers whether a crawler is
+// allowed to fetch a given URL. It follows RFC 9309, including the * and $
+// wildcards, plus the non-standard Crawl-delay and Sitemap lines most sites
+// use.
+package robots
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+MaxSize is the most of a robots.txt file we will read. RFC 9309 says crawlers
+must parse at least the first 500 KiB, so that is what we do.
+*/
+const MaxSize int64 = 500 * 1024
+
+/*
+Robots is a parsed robots.txt file. Sitemaps holds the URLs of any Sitemap
+lines, which apply to the whole file rather than to a group.
+*/
+type Robots struct {
+	groups   []*group
+	Sitemaps []string
+	// unavailable is set when we couldn't get the file at all, in which case
+	// everything is disallowed.
+	unavailable bool
+}
+
+/*
+Unavailable returns a Robots for a site whose robots.txt couldn't be fetched.
+It disallows everything.
+*/
+func Unavailable() *Robots {
+	return &Robots{unavailable: true}
+}
+
+/*
+group is one or more User-agent lines followed by the rules that apply to
+those agents.
+*/
+type group struct {
+	agents     []string
+	rules      []rule
+	crawlDelay time.Duration
+}
+
+/*
+rule is a single Allow or Disallow line. The pattern is kept around so we can
+say which rule excluded a URL.
+*/
+type rule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+/*
+String returns the rule as it would have been written in robots.txt.
+*/
+func (r rule) String() string {
+	if r.allow {
+		return "Allow: " + r.pattern
+	}
+	return "Disallow: " + r.pattern
+}
+
+/*
+Parse reads a robots.txt file. Lines it doesn't understand are ignored, as
+are rules that appear before any User-agent line, so Parse never fails - a
+garbage file just allows everything.
+*/
+func Parse(r io.Reader) *Robots {
+	robots := &Robots{}
+	var current *group
+	// Consecutive User-agent lines share the rules that follow them, so we
+	// need to know whether the last line we saw was one.
+	lastWasAgent := false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, MaxSize))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+
+		switch key {
+		case "user-agent":
+			if current == nil || !lastWasAgent {
+				current = &group{}
+				robots.groups = append(robots.groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			lastWasAgent = true
+			continue
+		case "allow", "disallow":
+			// An empty Disallow means "nothing is disallowed", which is the
+			// same as not having the rule at all.
+			if current != nil && value != "" {
+				current.rules = append(current.rules, newRule(key == "allow", value))
+			}
+		case "crawl-delay":
+			if current != nil {
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					current.crawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		case "sitemap":
+			if value != "" {
+				robots.Sitemaps = append(robots.Sitemaps, value)
+			}
+		}
+		lastWasAgent = false
+	}
+	return robots
+}
+
+/*
+newRule compiles a path pattern into a rule. * matches any run of characters
+and a trailing $ anchors the pattern to the end of the path. Everything else
+is a literal prefix.
+*/
+func newRule(allow bool, pattern string) rule {
+	expr := pattern
+	anchored := strings.HasSuffix(expr, "$")
+	if anchored {
+		expr = strings.TrimSuffix(expr, "$")
+	}
+	expr = strings.ReplaceAll(regexp.QuoteMeta(expr), `\*`, `.*`)
+	expr = "^" + expr
+	if anchored {
+		expr = expr + "$"
+	}
+	return rule{
+		allow:   allow,
+		pattern: pattern,
+		// Everything interesting has been quoted, so this can't fail.
+		re: regexp.MustCompile(expr),
+	}
+}
+
+/*
+AgentToken returns the part of a User-Agent header that robots.txt groups are
+matched against. For "go-charlotte/1.0 (+https://...)" that is "go-charlotte".
+*/
+func AgentToken(userAgent string) string {
+	token := strings.TrimSpace(userAgent)
+	if i := strings.IndexAny(token, "/ "); i >= 0 {
+		token = token[:i]
+	}
+	return token
+}
+
+/*
+groupsFor returns the groups that apply to agent. Every group naming the
+agent applies; if there are none, the * groups apply instead.
+*/
+func (r *Robots) groupsFor(agent string) []*group {
+	agent = strings.ToLower(agent)
+	var named, wildcard []*group
+	for _, g := range r.groups {
+		// A group can name the agent as well as *, so look at every one of
+		// its agents before deciding which it counts as.
+		isNamed, isWildcard := false, false
+		for _, a := range g.agents {
+			isNamed = isNamed || a == agent
+			isWildcard = isWildcard || a == "*"
+		}
+		if isNamed {
+			named = append(named, g)
+		} else if isWildcard {
+			wildcard = append(wildcard, g)
+		}
+	}
+	if len(named) > 0 {
+		return named
+	}
+	return wildcard
+}
+
+/*
+Check returns whether agent may fetch link, along with the rule that decided
+it. If no rule matched, the rule is the empty string. If the file couldn't be
+fetched at all, everything is disallowed. The longest matching pattern wins,
+and Allow wins a tie.
+*/
+func (r *Robots) Check(agent string, link *url.URL) (bool, string) {
+	if r.unavailable {
+		return false, "robots.txt unavailable"
+	}
+	path := link.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// robots.txt itself is always allowed.
+	if path == "/robots.txt" {
+		return true, ""
+	}
+	if link.RawQuery != "" {
+		path = path + "?" + link.RawQuery
+	}
+
+	var best *rule
+	for _, g := range r.groupsFor(agent) {
+		for i := range g.rules {
+			candidate := &g.rules[i]
+			if !candidate.re.MatchString(path) {
+				continue
+			}
+			if best == nil || len(candidate.pattern) > len(best.pattern) ||
+				(len(candidate.pattern) == len(best.pattern) && candidate.allow && !best.allow) {
+				best = candidate
+			}
+		}
+	}
+	if best == nil {
+		return true, ""
+	}
+	return best.allow, best.String()
+}
+
+/*
+Allowed returns whether agent may fetch link.
+*/
+func (r *Robots) Allowed(agent string, link *url.URL) bool {
+	allowed, _ := r.Check(agent, link)
+	return allowed
+}
+
+/*
+CrawlDelay returns how long agent has been asked to wait between requests, or
+zero if the file doesn't say.
+*/
+func (r *Robots) CrawlDelay(agent string) time.Duration {
+	var delay time.Duration
+	for _, g := range r.groupsFor(agent) {
+		if g.crawlDelay > delay {
+			delay = g.crawlDelay
+		}
+	}
+	return delay
+}
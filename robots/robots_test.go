@@ -0,0 +1,272 @@
+package robots
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRobots = `# A comment
+User-agent: go-charlotte
+User-agent: someotherbot
+Disallow: /private/
+Allow: /private/public
+Disallow: /*.pdf$
+Crawl-delay: 2
+
+User-agent: *
+Disallow: /
+
+Sitemap: https://kn100.me/sitemap.xml
+`
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("Couldn't parse %s. Err: %s", raw, err)
+	}
+	return u
+}
+
+func TestCheck(t *testing.T) {
+	robots := Parse(strings.NewReader(testRobots))
+	cases := []struct {
+		agent    string
+		link     string
+		expected bool
+	}{
+		{"go-charlotte", "https://kn100.me/", true},
+		{"Go-Charlotte", "https://kn100.me/private/secret", false},
+		{"go-charlotte", "https://kn100.me/private/public/page", true},
+		{"go-charlotte", "https://kn100.me/files/cv.pdf", false},
+		{"go-charlotte", "https://kn100.me/files/cv.pdf?download=1", true},
+		{"someotherbot", "https://kn100.me/private/", false},
+		{"anyone", "https://kn100.me/", false},
+		{"anyone", "https://kn100.me/robots.txt", true},
+	}
+	for _, c := range cases {
+		actual := robots.Allowed(c.agent, mustParseURL(t, c.link))
+		if actual != c.expected {
+			t.Errorf("Allowed(%s, %s) should have been %t", c.agent, c.link, c.expected)
+		}
+	}
+}
+
+func TestCheckReportsRule(t *testing.T) {
+	robots := Parse(strings.NewReader(testRobots))
+	allowed, rule := robots.Check("go-charlotte", mustParseURL(t, "https://kn100.me/private/x"))
+	if allowed || rule != "Disallow: /private/" {
+		t.Errorf("Expected to be disallowed by 'Disallow: /private/', got %t '%s'", allowed, rule)
+	}
+}
+
+func TestNamedAgentAfterWildcardInGroup(t *testing.T) {
+	robots := Parse(strings.NewReader("User-agent: *\nUser-agent: go-charlotte\nDisallow: /a\n\nUser-agent: go-charlotte\nDisallow: /b\n"))
+	for _, path := range []string{"/a", "/b"} {
+		if robots.Allowed("go-charlotte", mustParseURL(t, "https://kn100.me"+path)) {
+			t.Errorf("Expected %s to be disallowed for go-charlotte", path)
+		}
+	}
+	if !robots.Allowed("anyone", mustParseURL(t, "https://kn100.me/b")) {
+		t.Errorf("Expected /b to be allowed for anyone else")
+	}
+}
+
+func TestAllowWinsTie(t *testing.T) {
+	robots := Parse(strings.NewReader("User-agent: *\nDisallow: /page\nAllow: /page\n"))
+	if !robots.Allowed("go-charlotte", mustParseURL(t, "https://kn100.me/page")) {
+		t.Errorf("Allow should win when patterns are the same length")
+	}
+}
+
+func TestEmptyDisallowAllowsEverything(t *testing.T) {
+	robots := Parse(strings.NewReader("User-agent: *\nDisallow:\n"))
+	if !robots.Allowed("go-charlotte", mustParseURL(t, "https://kn100.me/anything")) {
+		t.Errorf("An empty Disallow should allow everything")
+	}
+}
+
+func TestCrawlDelayAndSitemaps(t *testing.T) {
+	robots := Parse(strings.NewReader(testRobots))
+	if robots.CrawlDelay("go-charlotte") != 2*time.Second {
+		t.Errorf("Expected a crawl delay of 2s, got %s", robots.CrawlDelay("go-charlotte"))
+	}
+	if robots.CrawlDelay("anyone") != 0 {
+		t.Errorf("Expected no crawl delay for the * group")
+	}
+	if len(robots.Sitemaps) != 1 || robots.Sitemaps[0] != "https://kn100.me/sitemap.xml" {
+		t.Errorf("Expected one sitemap, got %v", robots.Sitemaps)
+	}
+}
+
+func TestCacheFetchesOnce(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, "User-agent: *\nDisallow: /nope\n")
+	}))
+	defer ts.Close()
+
+	cache := NewCache(ts.Client(), "go-charlotte")
+	if ok, _ := cache.Check(context.Background(), mustParseURL(t, ts.URL+"/yep")); !ok {
+		t.Errorf("/yep should be allowed")
+	}
+	ok, reason := cache.Check(context.Background(), mustParseURL(t, ts.URL+"/nope"))
+	if ok || reason != "disallowed by robots.txt (Disallow: /nope)" {
+		t.Errorf("/nope should be disallowed with a reason, got %t '%s'", ok, reason)
+	}
+	if requests != 1 {
+		t.Errorf("Expected robots.txt to be fetched once, was fetched %d times", requests)
+	}
+}
+
+func TestCacheDoesNotHoldUpOtherHosts(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	requests := 0
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		<-release
+		fmt.Fprint(w, "User-agent: *\nCrawl-delay: 3\n")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /nope\n")
+	}))
+	defer fast.Close()
+
+	cache := NewCache(http.DefaultClient, "go-charlotte")
+	slowURL := mustParseURL(t, slow.URL+"/")
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Get(context.Background(), slowURL)
+		}()
+	}
+	// Give the slow fetch time to start, then check nothing waits on it.
+	time.Sleep(50 * time.Millisecond)
+	if delay := cache.CrawlDelay(slowURL); delay != 0 {
+		t.Errorf("Expected no Crawl-delay before robots.txt arrives, got %s", delay)
+	}
+	if ok, _ := cache.Check(context.Background(), mustParseURL(t, fast.URL+"/nope")); ok {
+		t.Errorf("/nope should be disallowed")
+	}
+	close(release)
+	wg.Wait()
+	if requests != 1 {
+		t.Errorf("Expected the slow robots.txt to be fetched once, was fetched %d times", requests)
+	}
+	if delay := cache.CrawlDelay(slowURL); delay != 3*time.Second {
+		t.Errorf("Expected a Crawl-delay of 3s once robots.txt arrived, got %s", delay)
+	}
+}
+
+func TestCacheRetriesAfterCancel(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, "User-agent: *\nDisallow: /nope\n")
+	}))
+	defer ts.Close()
+
+	cache := NewCache(ts.Client(), "go-charlotte")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ok, _ := cache.Check(ctx, mustParseURL(t, ts.URL+"/yep")); ok {
+		t.Errorf("Everything should be disallowed once ctx is cancelled")
+	}
+	if ok, _ := cache.Check(context.Background(), mustParseURL(t, ts.URL+"/yep")); !ok {
+		t.Errorf("A cancelled fetch shouldn't be remembered, /yep should be allowed")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	})
+	var links []*url.URL
+	for i := 0; i < 4; i++ {
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+		links = append(links, mustParseURL(t, ts.URL+"/a"), mustParseURL(t, ts.URL+"/b"))
+	}
+
+	cache := NewCache(http.DefaultClient, "go-charlotte")
+	cache.Prefetch(context.Background(), links, 2)
+	if most != 2 {
+		t.Errorf("Expected 2 robots.txt files to be fetched at once, got %d", most)
+	}
+	for _, link := range links {
+		cache.mu.Lock()
+		entry, ok := cache.files[link.Scheme+"://"+link.Host]
+		cache.mu.Unlock()
+		if !ok || entry.robots == nil {
+			t.Errorf("Expected robots.txt for %s to have been fetched", link.Host)
+		}
+	}
+}
+
+func TestCacheStatusHandling(t *testing.T) {
+	status := http.StatusNotFound
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	if !NewCache(ts.Client(), "go-charlotte").Get(context.Background(), mustParseURL(t, ts.URL)).Allowed("go-charlotte", mustParseURL(t, ts.URL+"/x")) {
+		t.Errorf("A 404 robots.txt should allow everything")
+	}
+	status = http.StatusServiceUnavailable
+	if NewCache(ts.Client(), "go-charlotte").Get(context.Background(), mustParseURL(t, ts.URL)).Allowed("go-charlotte", mustParseURL(t, ts.URL+"/x")) {
+		t.Errorf("A 503 robots.txt should disallow everything")
+	}
+}
+
+func TestAgentToken(t *testing.T) {
+	cases := map[string]string{
+		"go-charlotte/1.0 (+https://github.com/kn100/go-charlotte)": "go-charlotte",
+		"mybot":             "mybot",
+		"  spaced bot/1.0 ": "spaced",
+	}
+	for userAgent, expected := range cases {
+		if actual := AgentToken(userAgent); actual != expected {
+			t.Errorf("AgentToken(%q) should have been %q, got %q", userAgent, expected, actual)
+		}
+	}
+}
+
+func TestCacheSendsHeader(t *testing.T) {
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+	}))
+	defer ts.Close()
+
+	cache := NewCache(ts.Client(), "test-bot")
+	cache.Header = http.Header{"User-Agent": []string{"test-bot/2.0"}}
+	cache.Get(context.Background(), mustParseURL(t, ts.URL))
+	if userAgent != "test-bot/2.0" {
+		t.Errorf("Expected robots.txt to be requested as test-bot/2.0, got %s", userAgent)
+	}
+}
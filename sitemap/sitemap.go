@@ -1,18 +1,24 @@
 // Package sitemap provides a method of building and storing a sitemap.
+//
+// The reports a Sitemap can give (broken links, insecure links, redirects,
+// listed pages and XML sitemaps) only know about pages the crawl fetched.
+// Pages on the deepest level are found but never fetched, so their status
+// isn't known and their links aren't followed.
 package sitemap
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/kn100/charlotte/fetch"
 	"github.com/kn100/charlotte/util"
-	"golang.org/x/net/publicsuffix"
 )
 
 /*
@@ -20,83 +26,242 @@ IndentSpaces controls the number of spaces to indent string output
 */
 const IndentSpaces int = 2
 
-/*
-SitemapURLSIndexed is a map where the key is a URL, and the value is a pointer
-to its respective Node. It is here as an optimization to inserting into the
-Sitemap, avoiding having to do a search every time we want to append to the
-tree.
-*/
-var SitemapURLSIndexed = make(map[string]*Node)
-
 /*
 SiteMap stores metadata about a sitemap as well a pointer to the root Node.
-We can then traverse the entire tree from this one Node.
-RootEffectiveTLDPlusOne stores the tld, plus the part to the left of the dot.
-For example, blog.monzo.com's RootEffectiveTLDPlusOne becomes monzo.com
+We can then traverse the entire tree from this one Node. Only the exported
+fields with a JSON name are part of the output; the rest control the crawl.
 */
 type SiteMap struct {
-	RootNode                *Node  `json:"RootNode"`
+	RootNode *Node `json:"RootNode"`
+	// RootEffectiveTLDPlusOne stores the tld, plus the part to the left of
+	// the dot. For example, blog.monzo.com's RootEffectiveTLDPlusOne becomes
+	// monzo.com. Hosts that don't have one, like localhost:8080 or 10.0.0.1,
+	// are stored as they are, and only links to exactly that host and port
+	// are followed.
 	RootEffectiveTLDPlusOne string `json:"EffectiveTldPlusOne"`
 	Depth                   int    `json:"Depth"`
 	CreatedAt               int64  `json:"CreatedAt"`
 	FinishedAt              int64  `json:"FinishedAt"`
+	// Skipped lists the URLs that were found but deliberately not fetched.
+	Skipped []SkippedURL `json:"Skipped,omitempty"`
+	// SitemapFiles is every sitemap.xml we read looking for pages, and Listed
+	// is every page they listed, if the Crawler was asked to read them.
+	SitemapFiles []string `json:"SitemapFiles,omitempty"`
+	Listed       []string `json:"Listed,omitempty"`
+	// Edges is every link we found between pages in the site.
+	Edges []Edge `json:"Edges,omitempty"`
+	// Fetch controls how many requests the crawl may have in flight at once,
+	// and everything else about how pages are fetched. Anything left unset
+	// falls back to its default.
+	Fetch fetch.Options `json:"-"`
+	// Interrupted is set if the crawl was stopped before it finished, in
+	// which case the Sitemap only has what was found up to then.
+	Interrupted bool `json:"Interrupted,omitempty"`
+	// StoppedBy is set instead if the crawl stopped itself because it used
+	// up one of the Crawler's budgets.
+	StoppedBy Budget `json:"StoppedBy,omitempty"`
+	// IgnoreRobots turns off robots.txt checking, for domains that have
+	// consented to being crawled.
+	IgnoreRobots bool `json:"-"`
+	// Scope decides which links are followed. If it's nil when the root node
+	// is set, it becomes a util.SameSiteScope for the root.
+	Scope util.Scope `json:"-"`
+	// Normalizer decides which URLs count as the same page, and is
+	// util.DefaultNormalizer if it's nil.
+	Normalizer *util.Normalizer `json:"-"`
+
+	// mu guards the fields below and the tree of Nodes, so a SiteMap can be
+	// used from several goroutines at once.
+	mu sync.RWMutex
+	// index is a map where the key is a URL, and the value is a pointer to
+	// its respective Node. It is here as an optimization to inserting into
+	// the Sitemap, avoiding having to do a search every time we want to
+	// append to the tree. Each SiteMap has its own, so separate crawls never
+	// see each other's URLs.
+	index map[string]*Node
+	// edgeSet is there so we only keep one copy of each edge, as listedSet
+	// is for Listed.
+	edgeSet map[Edge]bool
+	// edgesByTarget has the index in Edges of every edge pointing at each
+	// page, by key, so finding the links to a page doesn't mean looking at
+	// them all.
+	edgesByTarget map[string][]int
+	listedSet     map[string]bool
+	// errs is every page that failed, for Errors.
+	errs []*URLError
+}
+
+/*
+SkippedURL records a URL that was in the sitemap but never fetched, and why.
+*/
+type SkippedURL struct {
+	URL    string `json:"URL"`
+	Reason string `json:"Reason"`
 }
 
 /*
-SetRootNode sets the root node of this Sitemap.
+SetRootNode sets the root node of this Sitemap. It returns false if there
+already was one, or if we can't work out which site baseURL belongs to.
 */
 func (s *SiteMap) SetRootNode(baseURL *url.URL) bool {
-	if s.RootNode != nil {
+	if err := s.setRoot(baseURL); err != nil {
+		s.logger().Printf("Couldn't set the root node. Err: %s\n", err)
 		return false
 	}
+	return true
+}
+
+/*
+setRoot is SetRootNode, but tells you why it failed. If it can't work out the
+site, the error is an *UnscopedHostError.
+*/
+func (s *SiteMap) setRoot(baseURL *url.URL) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RootNode != nil {
+		return errors.New("the sitemap already has a root node")
+	}
 	rootNode := Node{
 		URL:       baseURL,
 		CreatedAt: time.Now().Unix(),
 	}
 	s.RootNode = &rootNode
 
-	rootTLDPlusOne, err := publicsuffix.EffectiveTLDPlusOne(baseURL.Hostname())
+	rootTLDPlusOne, err := util.SiteKey(baseURL)
 	if err != nil {
-		fmt.Printf("I couldn't extract the TLD Plus One of baseURL %s. This means the sitemap won't be populated at all.\n", baseURL.String())
-		return false
+		return &UnscopedHostError{Host: baseURL.Host, Err: err}
 	}
 	s.RootEffectiveTLDPlusOne = rootTLDPlusOne
-	SitemapURLSIndexed[baseURL.String()] = &rootNode
-	return true
+	if s.Scope == nil {
+		s.Scope = util.SameSiteScope{Key: rootTLDPlusOne}
+	}
+	s.indexNode(&rootNode)
+	return nil
+}
+
+/*
+logger returns the logger in s.Fetch, or the standard logger if it isn't set.
+*/
+func (s *SiteMap) logger() *log.Logger {
+	if s.Fetch.Logger == nil {
+		return log.Default()
+	}
+	return s.Fetch.Logger
+}
+
+/*
+Lookup returns the Node for a URL, if it is in the Sitemap.
+*/
+func (s *SiteMap) Lookup(link *url.URL) (*Node, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	node, ok := s.index[s.key(link)]
+	return node, ok
+}
+
+/*
+indexNode adds node to the index. The caller must hold s.mu for writing.
+*/
+func (s *SiteMap) indexNode(node *Node) {
+	if s.index == nil {
+		s.index = make(map[string]*Node)
+	}
+	s.index[s.key(node.URL)] = node
+}
+
+/*
+key returns what link is indexed under, which is the same for every URL that
+s.Normalizer says is the same page.
+*/
+func (s *SiteMap) key(link *url.URL) string {
+	return s.normalizer().Key(link)
 }
 
 /*
 MakeSiteMap returns a sitemap, indexed from the seed up to the depth specified.
+It always returns a Sitemap, even if the seed was no good, and just logs what
+went wrong. Use Build if you want to know, or a Crawler if you want to change
+anything else.
 */
 func MakeSiteMap(seed string, depth int, httpTimeout time.Duration) *SiteMap {
-	sm := SiteMap{}
-	sm.CreatedAt = time.Now().Unix()
-	sm.Depth = depth
-	seedurl, err := url.Parse(seed)
+	sm, err := Build(context.Background(), seed, depth, httpTimeout)
 	if err != nil {
-		log.Printf("The seed URL (%s) didn't parse. Error was %s\n", seed, err)
-		return &sm
+		log.Printf("Couldn't make a sitemap for %s. Err: %s\n", seed, err)
+	}
+	if sm == nil {
+		sm = &SiteMap{CreatedAt: time.Now().Unix(), Depth: depth, Fetch: fetch.DefaultOptions()}
 	}
+	return sm
+}
+
+/*
+Build returns a sitemap, indexed from the seed up to the depth specified, or
+an error saying why it couldn't. It is the same as crawling with a Crawler
+that only has its depth and timeout set, so see Crawler.Crawl for what the
+errors mean.
+*/
+func Build(ctx context.Context, seed string, depth int, httpTimeout time.Duration) (*SiteMap, error) {
+	return NewCrawler(WithDepth(depth), WithTimeout(httpTimeout)).Crawl(ctx, seed)
+}
+
+/*
+Crawl fills in a Sitemap that already has its root node set, up to s.Depth,
+using s.Fetch, s.IgnoreRobots and s.Scope.
+*/
+func (s *SiteMap) Crawl(httpTimeout time.Duration) {
+	s.CrawlContext(context.Background(), httpTimeout)
+}
 
-	sm.SetRootNode(seedurl)
-	fillSiteMap(&sm, httpTimeout)
-	return &sm
+/*
+CrawlContext is Crawl, but stops early if ctx is cancelled or its deadline
+passes. Whatever was fetched before then stays in the Sitemap, FinishedAt is
+still set, and Interrupted is set so you can tell the crawl didn't complete.
+*/
+func (s *SiteMap) CrawlContext(ctx context.Context, httpTimeout time.Duration) {
+	if s.RootNode == nil {
+		s.logger().Println("Can't crawl a Sitemap without a root node.")
+		return
+	}
+	if s.CreatedAt == 0 {
+		s.CreatedAt = time.Now().Unix()
+	}
+	if s.Scope == nil {
+		s.Scope = util.SameSiteScope{Key: s.RootEffectiveTLDPlusOne}
+	}
+	crawler := NewCrawler(WithTimeout(httpTimeout), WithFetchOptions(s.Fetch), WithIgnoreRobots(s.IgnoreRobots))
+	crawler.fill(ctx, s)
 }
 
 /*
-String returns a human readable representation of the Sitemap.
+String returns a human readable representation of the Sitemap, followed by the
+URLs that were skipped, if any were, and which budget stopped the crawl, if
+one did.
 */
 func (s *SiteMap) String() string {
-	return s.RootNode.String()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	output := s.RootNode.String()
+	if len(s.Skipped) > 0 {
+		output = output + "\nSkipped:\n"
+		for _, skipped := range s.Skipped {
+			output = output + fmt.Sprintf("%s%s (%s)\n", strings.Repeat(" ", IndentSpaces), skipped.URL, skipped.Reason)
+		}
+	}
+	if s.StoppedBy != "" {
+		output = output + fmt.Sprintf("\nStopped early: ran out of %s.\n", s.StoppedBy)
+	}
+	return output
 }
 
 /*
 JSON returns a JSON representation of the Sitemap.
 */
 func (s *SiteMap) JSON() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	b, err := json.Marshal(s)
 	if err != nil {
-		log.Printf("Unable to marshal Sitemap into JSON. Error %s", err)
+		s.logger().Printf("Unable to marshal Sitemap into JSON. Error %s", err)
 		return "{}"
 	}
 	return string(b)
@@ -105,46 +270,21 @@ func (s *SiteMap) JSON() string {
 /*
 AddLeaf adds a leaf to this node (ie, a link that is traversable from this node)
 Returns false if it didn't add the node. If there is no error, then the node
-already existed (ie, this branch has been traversed), so it wasn't added.
-Returns true if new node
+already existed (ie, this branch has been traversed), so it wasn't added, but
+the link is still recorded. Returns true if new node. Use AddLink if you have
+the link's text too.
 */
 func (s *SiteMap) AddLeaf(from *url.URL, to *url.URL) (bool, error) {
-	if to.Hostname() == "" {
-		to = s.RootNode.URL.ResolveReference(to)
-	}
-	if s.RootNode == nil {
-		return false, errors.New("there was no root node set")
-	}
-
-	fromNode, seenFromURLBefore := SitemapURLSIndexed[from.String()]
-	if !seenFromURLBefore {
-		errText := fmt.Sprintf("from node %s is not in sitemap", from.String())
-		return false, errors.New(errText)
-	}
-	_, seenToURLBefore := SitemapURLSIndexed[to.String()]
-	if seenToURLBefore {
-		// We've already got this in the sitemap. Ignore. Will be better to add
-		// this to the sitemap too but it causes an infinite loop in the
-		// traversal methods. Didn't have time to investigate.
-		// TODO: Investigate solutions to this behaviour
-		return false, nil
-	}
-
-	// Fresh, unseen URL. Create the Node and add it to the sitemap
-	newNode := Node{
-		URL:       to,
-		CreatedAt: time.Now().Unix(),
-	}
-	fromNode.AddLeaf(&newNode)
-	SitemapURLSIndexed[to.String()] = &newNode
-	return true, nil
+	return s.AddLink(from, fetch.Link{URL: to})
 }
 
 /*
 GetNodesFromDepth returns nodes at a given depth in the tree.
 */
 func (s *SiteMap) GetNodesFromDepth(depth int) []*Node {
-	return getNodesFromDepth(*s.RootNode, 0, depth)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return getNodesFromDepth(s.RootNode, 0, depth)
 }
 
 /*
@@ -152,18 +292,18 @@ getNodesFromDepth is a recursive function that identifies nodes at a given
 depth. It does this by traversing the tree in a fan out, BFS style.
 Usage: getNodesFromDepth(startNode, 0, depth)
 */
-func getNodesFromDepth(startNode Node, currDepth int, depth int) []*Node {
+func getNodesFromDepth(startNode *Node, currDepth int, depth int) []*Node {
 	var nodesFound []*Node
 
 	if currDepth == depth {
 		var arr []*Node
-		arr = append(arr, &startNode)
+		arr = append(arr, startNode)
 		return arr
 	}
 	if currDepth < depth {
 		for i := 0; i < len(startNode.LinksTo); i++ {
 
-			nodes := getNodesFromDepth(*startNode.LinksTo[i], currDepth+1, depth)
+			nodes := getNodesFromDepth(startNode.LinksTo[i], currDepth+1, depth)
 
 			nodesFound = append(nodesFound, nodes...)
 		}
@@ -171,45 +311,22 @@ func getNodesFromDepth(startNode Node, currDepth int, depth int) []*Node {
 	return nodesFound
 }
 
-/*
-fillSiteMap traverses and fills in a given Sitemap.
-*/
-func fillSiteMap(sm *SiteMap, httpTimeout time.Duration) {
-	client := http.Client{
-		Timeout: httpTimeout,
-	}
-	checkDepth := 0
-	for checkDepth < sm.Depth {
-		nodes := sm.GetNodesFromDepth(checkDepth)
-		uris := getURLsFromNodeSlice(nodes)
-		jobResults := fetch.Links(&client, uris)
-		for i := 0; i < len(jobResults); i++ {
-			util.CleanURLS(jobResults[i].LinksTo)
-			jobResults[i].LinksTo = util.FilterLinksByHostname(jobResults[i].LinksTo, sm.RootEffectiveTLDPlusOne)
-		}
-		seenSomethingNew := addToSiteMap(sm, jobResults)
-		if !seenSomethingNew {
-			break
-		}
-		checkDepth++
-	}
-	sm.FinishedAt = time.Now().Unix()
-	sm.Depth = checkDepth
-}
-
 /*
 addToSiteMap takes a list of JobResults, and parses through them to add new
-links to the sitemap. Returns true if it added something, false if it did not
+links to the sitemap. What we learnt about each response is recorded on the
+Node it came from. Returns true if it added something, false if it did not
 (because there were no new links to add)
 */
 func addToSiteMap(sitemap *SiteMap, jobResults []fetch.JobResult) bool {
 	seenSomethingNew := false
 	for i := 0; i < len(jobResults); i++ {
 		fromNode := jobResults[i].FromURL
+		sitemap.recordResponse(jobResults[i])
 		for j := 0; j < len(jobResults[i].LinksTo); j++ {
-			added, err := sitemap.AddLeaf(fromNode, jobResults[i].LinksTo[j])
+			link := jobResults[i].LinksTo[j]
+			added, err := sitemap.AddLink(fromNode, link)
 			if err != nil {
-				log.Printf("error adding entry %s from %s to Sitemap, err: %s", jobResults[i].LinksTo[j].String(), fromNode.String(), err)
+				sitemap.logger().Printf("error adding entry %s from %s to Sitemap, err: %s", link.URL.String(), fromNode.String(), err)
 			}
 			if added == true {
 				seenSomethingNew = true
@@ -219,6 +336,79 @@ func addToSiteMap(sitemap *SiteMap, jobResults []fetch.JobResult) bool {
 	return seenSomethingNew
 }
 
+/*
+cleanAndFilterLinks normalizes every link's URL, then removes the links that
+are out of scope. Anything that isn't http or https (mailto:, tel:,
+javascript: and so on) can't be crawled, so it never gets as far as the scope.
+*/
+func cleanAndFilterLinks(links []fetch.Link, scope util.Scope, normalizer util.Normalizer) []fetch.Link {
+	var acceptableLinks []fetch.Link
+	for i := 0; i < len(links); i++ {
+		scheme := strings.ToLower(links[i].URL.Scheme)
+		if scheme != "http" && scheme != "https" {
+			continue
+		}
+		normalizer.Normalize(links[i].URL)
+		if scope.InScope(links[i].URL) {
+			acceptableLinks = append(acceptableLinks, links[i])
+		}
+	}
+	return acceptableLinks
+}
+
+/*
+normalizer returns s.Normalizer, or the default one if it isn't set.
+*/
+func (s *SiteMap) normalizer() util.Normalizer {
+	if s.Normalizer == nil {
+		return util.DefaultNormalizer()
+	}
+	return *s.Normalizer
+}
+
+/*
+recordResponse copies the response metadata from a JobResult onto the Node
+for the URL that was fetched. If we were redirected, the URL we ended up at is
+indexed to the same Node, so links straight to it count as links to this page
+rather than a new one.
+*/
+func (s *SiteMap) recordResponse(result fetch.JobResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.index[s.key(result.FromURL)]
+	if !ok {
+		return
+	}
+	node.StatusCode = result.StatusCode
+	node.ContentType = result.ContentType
+	node.ContentLength = result.ContentLength
+	node.Truncated = result.Truncated
+	if !result.LastModified.IsZero() {
+		node.LastModified = result.LastModified.Unix()
+	}
+	node.ResponseTime = result.ResponseTime
+	node.Redirects = result.Redirects
+	if result.FinalURL != nil && result.FinalURL.String() != result.FromURL.String() {
+		node.FinalURL = result.FinalURL.String()
+		// Links to where we ended up will have been normalized, so the
+		// alias needs to be too.
+		finalURL := *result.FinalURL
+		s.normalizer().Normalize(&finalURL)
+		if _, ok := s.index[s.key(&finalURL)]; !ok {
+			s.index[s.key(&finalURL)] = node
+		}
+	}
+	if result.Err != nil {
+		node.FetchError = result.Err.Error()
+	}
+	if result.ReadErr != nil {
+		node.ReadError = result.ReadErr.Error()
+	}
+	if result.Err != nil || result.StatusCode >= 400 {
+		s.errs = append(s.errs, &URLError{URL: result.FromURL.String(), StatusCode: result.StatusCode, Err: result.Err})
+	}
+}
+
 /*
 getURLSFromNodeSlice takes a slice of Nodes, and extracts out the URL fields. It
 then returns a slice of these URLS
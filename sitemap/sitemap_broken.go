@@ -0,0 +1,88 @@
+package sitemap
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Referrer is a page that links to another, along with the text of the link.
+*/
+type Referrer struct {
+	URL  string `json:"URL"`
+	Text string `json:"Text"`
+}
+
+/*
+BrokenLink is a URL that returned a 4xx or 5xx, or couldn't be loaded at all,
+along with every page we found linking to it.
+*/
+type BrokenLink struct {
+	URL        string     `json:"URL"`
+	StatusCode int        `json:"StatusCode,omitempty"`
+	Error      string     `json:"Error,omitempty"`
+	LinkedFrom []Referrer `json:"LinkedFrom"`
+}
+
+/*
+BrokenLinks returns every broken link in the Sitemap, in the order they appear
+in the tree.
+*/
+func (s *SiteMap) BrokenLinks() []BrokenLink {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var broken []BrokenLink
+	if s.RootNode == nil {
+		return broken
+	}
+	s.RootNode.walk(func(node *Node) {
+		if node.StatusCode < 400 && node.FetchError == "" {
+			return
+		}
+		broken = append(broken, BrokenLink{
+			URL:        node.URL.String(),
+			StatusCode: node.StatusCode,
+			Error:      node.FetchError,
+			LinkedFrom: s.referrersOf(node.URL.String()),
+		})
+	})
+	return broken
+}
+
+/*
+BrokenLinksReport returns a human readable list of broken links, each followed
+by the pages that link to it.
+*/
+func (s *SiteMap) BrokenLinksReport() string {
+	broken := s.BrokenLinks()
+	if len(broken) == 0 {
+		return "No broken links found.\n"
+	}
+	indent := strings.Repeat(" ", IndentSpaces)
+	output := ""
+	for _, b := range broken {
+		output = output + b.URL
+		if b.StatusCode != 0 {
+			output = output + fmt.Sprintf(" [%d]", b.StatusCode)
+		}
+		if b.Error != "" {
+			output = output + fmt.Sprintf(" (%s)", b.Error)
+		}
+		output = output + "\n"
+		for _, r := range b.LinkedFrom {
+			output = output + fmt.Sprintf("%slinked from %s (%q)\n", indent, r.URL, r.Text)
+		}
+	}
+	return output
+}
+
+/*
+referrersOf returns the pages linking to a URL. The caller must hold s.mu.
+*/
+func (s *SiteMap) referrersOf(to string) []Referrer {
+	var referrers []Referrer
+	for _, edge := range s.edgesTo(to) {
+		referrers = append(referrers, Referrer{URL: edge.From, Text: edge.Text})
+	}
+	return referrers
+}
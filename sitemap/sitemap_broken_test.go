@@ -0,0 +1,85 @@
+package sitemap
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/kn100/charlotte/fetch"
+)
+
+/*
+brokenLinksSiteMap builds a sitemap where /gone is a 404 linked from the home
+page and /about, and /down couldn't be loaded at all.
+*/
+func brokenLinksSiteMap() *SiteMap {
+	return buildSiteMap(&SiteMap{Depth: 2},
+		[]fetch.JobResult{{
+			FromURL:    mustParseURL("https://kn100.me/"),
+			StatusCode: 200,
+			LinksTo: []fetch.Link{
+				{URL: mustParseURL("https://kn100.me/about"), Text: "About"},
+				{URL: mustParseURL("https://kn100.me/gone"), Text: "Old page"},
+			},
+		}},
+		[]fetch.JobResult{
+			{
+				FromURL:    mustParseURL("https://kn100.me/about"),
+				StatusCode: 200,
+				LinksTo: []fetch.Link{
+					{URL: mustParseURL("https://kn100.me/gone"), Text: "That old page"},
+					{URL: mustParseURL("https://kn100.me/down"), Text: "Status"},
+				},
+			},
+			{FromURL: mustParseURL("https://kn100.me/gone"), StatusCode: 404},
+		},
+		[]fetch.JobResult{{FromURL: mustParseURL("https://kn100.me/down"), Err: errors.New("connection refused")}},
+	)
+}
+
+func TestBrokenLinks(t *testing.T) {
+	sm := brokenLinksSiteMap()
+	broken := sm.BrokenLinks()
+	if len(broken) != 2 {
+		t.Fatalf("Expected 2 broken links, got %d", len(broken))
+	}
+	// /down was found from /about, so it comes before /gone in the tree.
+	if broken[0].URL != "https://kn100.me/down" || broken[0].Error != "connection refused" {
+		t.Errorf("Expected the first broken link to be /down with an error, got %+v", broken[0])
+	}
+	if broken[1].URL != "https://kn100.me/gone" || broken[1].StatusCode != 404 {
+		t.Errorf("Expected the second broken link to be /gone with a 404, got %+v", broken[1])
+	}
+	if len(broken[1].LinkedFrom) != 2 {
+		t.Fatalf("Expected /gone to be linked from 2 pages, got %d", len(broken[1].LinkedFrom))
+	}
+	if broken[1].LinkedFrom[1].URL != "https://kn100.me/about" || broken[1].LinkedFrom[1].Text != "That old page" {
+		t.Errorf("Expected /gone to be linked from /about, got %+v", broken[1].LinkedFrom[1])
+	}
+}
+
+func TestBrokenLinksReport(t *testing.T) {
+	sm := brokenLinksSiteMap()
+	expected := `https://kn100.me/down (connection refused)
+  linked from https://kn100.me/about ("Status")
+https://kn100.me/gone [404]
+  linked from https://kn100.me/ ("Old page")
+  linked from https://kn100.me/about ("That old page")
+`
+	actual := sm.BrokenLinksReport()
+	if actual != expected {
+		t.Errorf("The report did not match what was expected.\n Expected: \n %s\n Actual:\n %s\n", expected, actual)
+	}
+}
+
+func TestNoBrokenLinks(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	sm := SiteMap{Depth: 1}
+	sm.SetRootNode(baseURL)
+	if len(sm.BrokenLinks()) != 0 {
+		t.Errorf("Expected no broken links")
+	}
+	if sm.BrokenLinksReport() != "No broken links found.\n" {
+		t.Errorf("Expected to be told there were no broken links")
+	}
+}
@@ -0,0 +1,537 @@
+package sitemap
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kn100/charlotte/fetch"
+	"github.com/kn100/charlotte/robots"
+	"github.com/kn100/charlotte/util"
+)
+
+const (
+	// DefaultDepth is how many links deep a Crawler goes if not told otherwise.
+	DefaultDepth int = 5
+	// DefaultTimeout is the timeout for each request a Crawler makes if not
+	// told otherwise.
+	DefaultTimeout time.Duration = 10 * time.Second
+)
+
+/*
+Budget is one of the limits a Crawler can be given on how much it does. When a
+crawl stops because it used one up, the Sitemap's StoppedBy says which.
+*/
+type Budget string
+
+const (
+	// BudgetPages is the limit on how many pages are fetched.
+	BudgetPages Budget = "pages"
+	// BudgetBytes is the limit on how many bytes of pages are downloaded.
+	BudgetBytes Budget = "bytes"
+	// BudgetTime is the limit on how long the crawl takes.
+	BudgetTime Budget = "time"
+)
+
+/*
+Crawler builds Sitemaps. Make one with NewCrawler and whichever Options you
+need, then call Crawl as many times as you like; each call gets its own
+Sitemap. Anything you don't set falls back to the defaults, which are the same
+as MakeSiteMap's.
+*/
+type Crawler struct {
+	depth        int
+	timeout      time.Duration
+	client       *http.Client
+	fetch        fetch.Options
+	scope        util.Scope
+	normalizer   *util.Normalizer
+	ignoreRobots bool
+	sitemapSeeds bool
+	maxPages     int
+	maxBytes     int64
+	maxDuration  time.Duration
+	onPage       func(result fetch.JobResult)
+	onSkip       func(skipped SkippedURL)
+}
+
+/*
+Option changes one thing about a Crawler. Options are applied in the order
+they're given, so if two of them set the same thing, the last one wins.
+*/
+type Option func(c *Crawler)
+
+/*
+NewCrawler returns a Crawler with opts applied on top of the defaults.
+*/
+func NewCrawler(opts ...Option) *Crawler {
+	c := &Crawler{
+		depth:   DefaultDepth,
+		timeout: DefaultTimeout,
+		fetch:   fetch.DefaultOptions(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+/*
+WithDepth sets how many links deep to crawl.
+*/
+func WithDepth(depth int) Option {
+	return func(c *Crawler) {
+		c.depth = depth
+	}
+}
+
+/*
+WithTimeout sets the timeout for each request. It's ignored if WithClient is
+used, since the client has its own.
+*/
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Crawler) {
+		c.timeout = timeout
+	}
+}
+
+/*
+WithClient makes every request, robots.txt included, with client.
+*/
+func WithClient(client *http.Client) Option {
+	return func(c *Crawler) {
+		c.client = client
+	}
+}
+
+/*
+WithFetchOptions replaces every fetch setting at once. It undoes any of
+WithConcurrency, WithUserAgent, WithHeaders, WithRetries, WithLinkKinds,
+WithLinkTags, WithMaxBodySize and WithLogger that came before it.
+*/
+func WithFetchOptions(opts fetch.Options) Option {
+	return func(c *Crawler) {
+		c.fetch = opts
+	}
+}
+
+/*
+WithConcurrency sets the most requests in flight at once overall, and against
+any one host.
+*/
+func WithConcurrency(total int, perHost int) Option {
+	return func(c *Crawler) {
+		c.fetch.Concurrency = total
+		c.fetch.PerHostConcurrency = perHost
+	}
+}
+
+/*
+WithScope decides which links are followed. The default is the seed's whole
+site (see util.SameSiteScope).
+*/
+func WithScope(scope util.Scope) Option {
+	return func(c *Crawler) {
+		c.scope = scope
+	}
+}
+
+/*
+WithNormalizer decides which URLs count as the same page. The default is
+util.DefaultNormalizer.
+*/
+func WithNormalizer(normalizer util.Normalizer) Option {
+	return func(c *Crawler) {
+		c.normalizer = &normalizer
+	}
+}
+
+/*
+WithUserAgent sets the User-Agent sent with every request. Its first word is
+also who we are as far as robots.txt is concerned.
+*/
+func WithUserAgent(userAgent string) Option {
+	return func(c *Crawler) {
+		c.fetch.UserAgent = userAgent
+	}
+}
+
+/*
+WithHeaders adds header to every request, on top of any headers that were
+already set. It can be given more than once, and the values pile up like
+http.Header's Add, rather than replacing each other.
+*/
+func WithHeaders(header http.Header) Option {
+	return func(c *Crawler) {
+		// Copy before adding, so we never write to a map the caller owns.
+		merged := c.fetch.Headers.Clone()
+		if merged == nil {
+			merged = make(http.Header)
+		}
+		for name, values := range header {
+			for _, value := range values {
+				merged.Add(name, value)
+			}
+		}
+		c.fetch.Headers = merged
+	}
+}
+
+/*
+WithRetries sets how many more times a failed request is tried before we give
+up on it. Zero means never retry.
+*/
+func WithRetries(retries int) Option {
+	return func(c *Crawler) {
+		c.fetch.Retries = retries
+		c.fetch.NoRetries = retries == 0
+	}
+}
+
+/*
+WithLinkKinds sets which kinds of link are followed, fetch.DefaultLinkKinds
+if you don't. Add fetch.KindResource to check images, scripts and stylesheets
+too.
+*/
+func WithLinkKinds(kinds ...fetch.LinkKind) Option {
+	return func(c *Crawler) {
+		c.fetch.LinkKinds = kinds
+	}
+}
+
+/*
+WithLinkTags sets which tags links are looked for in, fetch.DefaultLinkTags if
+you don't. It works on top of WithLinkKinds, so WithLinkTags("a", "iframe")
+follows frames without following <link rel="next">.
+*/
+func WithLinkTags(tags ...string) Option {
+	return func(c *Crawler) {
+		c.fetch.LinkTags = tags
+	}
+}
+
+/*
+WithMaxBodySize sets the most of any one page that's read looking for links.
+*/
+func WithMaxBodySize(maxBodySize int64) Option {
+	return func(c *Crawler) {
+		c.fetch.MaxBodySize = maxBodySize
+	}
+}
+
+/*
+WithMaxPages stops the crawl once this many pages have been fetched. Pages
+found but not fetched by then are still in the Sitemap. Zero, the default,
+means no limit.
+*/
+func WithMaxPages(maxPages int) Option {
+	return func(c *Crawler) {
+		c.maxPages = maxPages
+	}
+}
+
+/*
+WithMaxBytes stops the crawl once this many bytes of pages have been
+downloaded. Requests that are in flight when that happens are abandoned, but
+the ones that had already finished are kept, so the total can go over by a
+few pages. Zero, the default, means no limit.
+*/
+func WithMaxBytes(maxBytes int64) Option {
+	return func(c *Crawler) {
+		c.maxBytes = maxBytes
+	}
+}
+
+/*
+WithMaxDuration stops the crawl once it has been running this long, abandoning
+any requests in flight. Zero, the default, means no limit.
+*/
+func WithMaxDuration(maxDuration time.Duration) Option {
+	return func(c *Crawler) {
+		c.maxDuration = maxDuration
+	}
+}
+
+/*
+WithIgnoreRobots turns off robots.txt checking. Only for domains that have
+consented to being crawled!
+*/
+func WithIgnoreRobots(ignore bool) Option {
+	return func(c *Crawler) {
+		c.ignoreRobots = ignore
+	}
+}
+
+/*
+WithSitemapSeeds makes the crawl read the site's sitemap.xml files (the ones
+named in robots.txt, and /sitemap.xml) before it starts, and crawl every page
+they list as well as the ones it finds links to. SiteMap.ListedPages then says
+which of them nothing links to.
+*/
+func WithSitemapSeeds(sitemapSeeds bool) Option {
+	return func(c *Crawler) {
+		c.sitemapSeeds = sitemapSeeds
+	}
+}
+
+/*
+WithLogger sends everything the crawl would have logged to logger instead of
+the standard logger.
+*/
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Crawler) {
+		c.fetch.Logger = logger
+	}
+}
+
+/*
+OnPage calls hook with the result of every page fetched, as soon as it's been
+added to the Sitemap. LinksTo only has the links that are in scope. Hooks are
+called one at a time, from the goroutine that called Crawl.
+*/
+func OnPage(hook func(result fetch.JobResult)) Option {
+	return func(c *Crawler) {
+		c.onPage = hook
+	}
+}
+
+/*
+OnSkip calls hook for every URL that was found but deliberately not fetched.
+*/
+func OnSkip(hook func(skipped SkippedURL)) Option {
+	return func(c *Crawler) {
+		c.onSkip = hook
+	}
+}
+
+/*
+Crawl returns a sitemap for seed, or an error saying why it couldn't make one.
+The error is an *InvalidSeedError if seed isn't a URL, an *UnscopedHostError if
+we can't tell which site it belongs to (there's no Sitemap in either case), a
+*SeedFetchError if the seed itself couldn't be loaded, or a *SeedSkippedError
+if robots.txt wouldn't let us fetch it (or couldn't be fetched itself). If ctx
+is cancelled part way through, you get the partial Sitemap along with ctx's
+error. Running out of a budget isn't an error, it just sets the Sitemap's
+StoppedBy. Pages other than the seed failing doesn't make Crawl fail, but they
+are all listed by the Sitemap's Errors method.
+*/
+func (c *Crawler) Crawl(ctx context.Context, seed string) (*SiteMap, error) {
+	seedURL, err := url.Parse(seed)
+	if err != nil {
+		return nil, &InvalidSeedError{Seed: seed, Err: err}
+	}
+	if seedURL.Host == "" {
+		return nil, &InvalidSeedError{Seed: seed}
+	}
+	sm := &SiteMap{
+		Depth:        c.depth,
+		Fetch:        c.fetch,
+		IgnoreRobots: c.ignoreRobots,
+		Scope:        c.scope,
+		Normalizer:   c.normalizer,
+	}
+	sm.CreatedAt = time.Now().Unix()
+	// The seed is written like any other link, so it has to be normalized
+	// like one, or a link back to it would look like a new page.
+	sm.normalizer().Normalize(seedURL)
+	seedURL = sm.normalizer().Preferred(seedURL)
+	if err := sm.setRoot(seedURL); err != nil {
+		return nil, err
+	}
+	c.fill(ctx, sm)
+	if err := sm.seedError(); err != nil {
+		return sm, err
+	}
+	if sm.Interrupted {
+		return sm, ctx.Err()
+	}
+	return sm, nil
+}
+
+/*
+fill traverses and fills in a given Sitemap, until it runs out of depth, new
+links, ctx or one of its budgets. sm's root node and Scope must already be set.
+*/
+func (c *Crawler) fill(ctx context.Context, sm *SiteMap) {
+	client := c.client
+	if client == nil {
+		client = &http.Client{Timeout: c.timeout}
+	}
+	// Running out of time is just like being cancelled, except it's us that
+	// did the cancelling.
+	crawlCtx := ctx
+	if c.maxDuration > 0 {
+		var cancel context.CancelFunc
+		crawlCtx, cancel = context.WithTimeout(ctx, c.maxDuration)
+		defer cancel()
+	}
+	opts := sm.Fetch
+	var robotsCache *robots.Cache
+	if !sm.IgnoreRobots {
+		// robots.txt should see the same User-Agent and headers the pages do.
+		header := opts.RequestHeader()
+		robotsCache = robots.NewCache(client, robots.AgentToken(header.Get("User-Agent")))
+		robotsCache.Header = header
+		robotsCache.Logger = sm.logger()
+		if opts.HostDelay == nil {
+			opts.HostDelay = robotsCache.CrawlDelay
+		}
+	}
+	if opts.Limiter == nil {
+		// Every frontier is its own call to fetch.Links, but a host's limits
+		// and Crawl-delay carry on from one to the next.
+		opts.Limiter = fetch.NewHostLimiter(opts.PerHostConcurrency)
+	}
+	if opts.FollowRedirect == nil {
+		opts.FollowRedirect = followable(crawlCtx, sm, robotsCache)
+	}
+	if c.sitemapSeeds {
+		c.addSitemapSeeds(crawlCtx, client, sm, robotsCache, opts)
+	}
+	normalizer := sm.normalizer()
+	fetched := 0
+	var downloaded int64
+	checkDepth := 0
+	for checkDepth < sm.Depth {
+		nodes := sm.GetNodesFromDepth(checkDepth)
+		uris := getURLsFromNodeSlice(nodes)
+		if robotsCache != nil {
+			uris = c.allowedByRobots(crawlCtx, sm, robotsCache, uris)
+		}
+		if c.maxPages > 0 && len(uris) > c.maxPages-fetched {
+			uris = uris[:c.maxPages-fetched]
+			sm.StoppedBy = BudgetPages
+		}
+
+		// The byte budget can run out part way through a frontier, so the
+		// frontier gets its own context we can cancel when it does.
+		levelCtx, cancelLevel := context.WithCancel(crawlCtx)
+		levelOpts := opts
+		if c.maxBytes > 0 {
+			levelOpts.OnResult = func(result fetch.JobResult) {
+				downloaded += result.BytesRead
+				if downloaded >= c.maxBytes {
+					cancelLevel()
+				}
+			}
+		}
+		jobResults := fetch.Links(levelCtx, client, uris, levelOpts)
+		fetched += len(jobResults)
+		if levelCtx.Err() != nil {
+			// Pages we were in the middle of fetching when we were told to
+			// stop aren't broken, we just don't know about them. Keep the
+			// rest.
+			jobResults = withoutCancelled(levelCtx, jobResults)
+			switch {
+			case ctx.Err() != nil:
+				sm.Interrupted = true
+			case crawlCtx.Err() != nil:
+				sm.StoppedBy = BudgetTime
+			default:
+				sm.StoppedBy = BudgetBytes
+			}
+		}
+		cancelLevel()
+		for i := 0; i < len(jobResults); i++ {
+			jobResults[i].LinksTo = cleanAndFilterLinks(jobResults[i].LinksTo, sm.Scope, normalizer)
+		}
+		// Pages from sitemap.xml are in the tree before anything links to
+		// them, so there can be more to do even if nothing new turned up.
+		seenSomethingNew := addToSiteMap(sm, jobResults) || len(sm.GetNodesFromDepth(checkDepth+1)) > 0
+		if c.onPage != nil {
+			for i := 0; i < len(jobResults); i++ {
+				c.onPage(jobResults[i])
+			}
+		}
+		if seenSomethingNew {
+			checkDepth++
+		}
+		if !seenSomethingNew || sm.Interrupted || sm.StoppedBy != "" {
+			break
+		}
+	}
+	sm.FinishedAt = time.Now().Unix()
+	sm.Depth = checkDepth
+}
+
+/*
+followable returns the check fetch uses to decide whether a redirect is worth
+following. Where a redirect goes isn't known until we're fetching, so it can't
+be vetted like a link: it has to be a web page in sm's Scope, and robots.txt
+has to let us fetch it, unless cache is nil.
+*/
+func followable(ctx context.Context, sm *SiteMap, cache *robots.Cache) func(link *url.URL) bool {
+	normalizer := sm.normalizer()
+	return func(link *url.URL) bool {
+		if link.Scheme != "http" && link.Scheme != "https" {
+			return false
+		}
+		normalized := *link
+		normalizer.Normalize(&normalized)
+		if !sm.Scope.InScope(&normalized) {
+			return false
+		}
+		if cache == nil {
+			return true
+		}
+		ok, _ := cache.Check(ctx, link)
+		return ok
+	}
+}
+
+/*
+withoutCancelled drops the JobResults that failed because ctx was cancelled,
+including pages we were part way through reading.
+*/
+func withoutCancelled(ctx context.Context, jobResults []fetch.JobResult) []fetch.JobResult {
+	var kept []fetch.JobResult
+	for i := 0; i < len(jobResults); i++ {
+		if ctx.Err() != nil && errors.Is(jobResults[i].Err, ctx.Err()) {
+			continue
+		}
+		kept = append(kept, jobResults[i])
+	}
+	return kept
+}
+
+/*
+allowedByRobots returns the URLs robots.txt lets us fetch, recording the rest
+in sm.Skipped. The robots.txt files for every host in the frontier are fetched
+up front, as many at once as we're allowed pages. If ctx is cancelled part way
+through, it stops there.
+*/
+func (c *Crawler) allowedByRobots(ctx context.Context, sm *SiteMap, cache *robots.Cache, uris []*url.URL) []*url.URL {
+	workers := sm.Fetch.Concurrency
+	if workers < 1 {
+		workers = fetch.DefaultConcurrency
+	}
+	cache.Prefetch(ctx, uris, workers)
+	var allowed []*url.URL
+	for i := 0; i < len(uris); i++ {
+		ok, reason := cache.Check(ctx, uris[i])
+		if ctx.Err() != nil {
+			break
+		}
+		if !ok {
+			c.skip(sm, SkippedURL{URL: uris[i].String(), Reason: reason})
+			continue
+		}
+		allowed = append(allowed, uris[i])
+	}
+	return allowed
+}
+
+/*
+skip records a URL we decided not to fetch, and tells the OnSkip hook.
+*/
+func (c *Crawler) skip(sm *SiteMap, skipped SkippedURL) {
+	sm.mu.Lock()
+	sm.Skipped = append(sm.Skipped, skipped)
+	sm.mu.Unlock()
+	if c.onSkip != nil {
+		c.onSkip(skipped)
+	}
+}
@@ -0,0 +1,303 @@
+package sitemap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kn100/charlotte/fetch"
+	"github.com/kn100/charlotte/util"
+)
+
+func TestCrawlerOptions(t *testing.T) {
+	var mu sync.Mutex
+	userAgents := make(map[string]bool)
+	site := testSite()
+	defer site.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents[r.Header.Get("User-Agent")+" "+r.Header.Get("X-Test")] = true
+		mu.Unlock()
+		site.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	seedURL, _ := url.Parse(ts.URL + "/")
+	header := http.Header{"X-Test": {"yes"}}
+	crawler := NewCrawler(
+		WithDepth(1),
+		WithClient(ts.Client()),
+		WithUserAgent("testbot/2.0"),
+		WithHeaders(header),
+		WithScope(util.NewExactHostScope(seedURL)),
+	)
+	sm, err := crawler.Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(userAgents) != 1 || !userAgents["testbot/2.0 yes"] {
+		t.Errorf("Expected every request to use the User-Agent and headers given, got %v", userAgents)
+	}
+	deepURL, _ := url.Parse(ts.URL + "/deep")
+	if _, ok := sm.Lookup(deepURL); ok {
+		t.Errorf("Depth 1 should never have found /deep")
+	}
+}
+
+func TestWithHeadersAddsToExistingHeaders(t *testing.T) {
+	opts := fetch.DefaultOptions()
+	opts.Headers = http.Header{"X-First": {"1"}}
+	crawler := NewCrawler(
+		WithFetchOptions(opts),
+		WithHeaders(http.Header{"X-Second": {"2"}}),
+		WithHeaders(http.Header{"X-Second": {"again"}}),
+	)
+	headers := crawler.fetch.Headers
+	if headers.Get("X-First") != "1" || len(headers.Values("X-Second")) != 2 {
+		t.Errorf("Expected every header given to be kept, got %v", headers)
+	}
+	if len(opts.Headers) != 1 {
+		t.Errorf("Expected the headers passed in not to be changed, got %v", opts.Headers)
+	}
+}
+
+func TestCrawlerMaxPages(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	var fetched []string
+	crawler := NewCrawler(WithMaxPages(2), WithIgnoreRobots(true), OnPage(func(result fetch.JobResult) {
+		fetched = append(fetched, result.FromURL.Path)
+	}))
+	sm, err := crawler.Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(fetched) != 2 || fetched[0] != "/" {
+		t.Errorf("Expected the root and one more page to be fetched, got %v", fetched)
+	}
+	if sm.FinishedAt == 0 {
+		t.Errorf("Expected FinishedAt to be set")
+	}
+	if sm.StoppedBy != BudgetPages {
+		t.Errorf("Expected the page budget to have stopped the crawl, got %q", sm.StoppedBy)
+	}
+}
+
+func TestCrawlerMaxPagesNotReached(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	sm, _ := NewCrawler(WithMaxPages(100)).Crawl(context.Background(), ts.URL+"/")
+	if sm.StoppedBy != "" {
+		t.Errorf("Expected the crawl to finish by itself, got %q", sm.StoppedBy)
+	}
+}
+
+func TestCrawlerMaxBytes(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	// The root page alone is bigger than this.
+	sm, err := NewCrawler(WithMaxBytes(10), WithIgnoreRobots(true)).Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Running out of bytes shouldn't be an error, got %s", err)
+	}
+	if sm.StoppedBy != BudgetBytes {
+		t.Errorf("Expected the byte budget to have stopped the crawl, got %q", sm.StoppedBy)
+	}
+	aboutURL, _ := url.Parse(ts.URL + "/about")
+	if node, ok := sm.Lookup(aboutURL); !ok || node.StatusCode != 0 {
+		t.Errorf("Expected /about to be found but never fetched")
+	}
+	if !strings.Contains(sm.String(), "Stopped early: ran out of bytes.") {
+		t.Errorf("Expected the output to say why the crawl stopped, got %s", sm.String())
+	}
+}
+
+func TestCrawlerMaxBytesOnlyCountsWhatWasDownloaded(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big.pdf" {
+			// Only ever asked for with HEAD, so it never has to send this.
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Length", "10000000")
+			return
+		}
+		fmt.Fprint(w, `<a href="/big.pdf">CV</a><a href="/about">About</a>`)
+	}))
+	defer ts.Close()
+
+	sm, err := NewCrawler(WithDepth(3), WithMaxBytes(1000), WithIgnoreRobots(true)).Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if sm.StoppedBy != "" {
+		t.Errorf("A file we never downloaded shouldn't use up the byte budget, got stopped by %q", sm.StoppedBy)
+	}
+}
+
+func TestCrawlerMaxDuration(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/slow">Slow</a>`))
+			return
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	sm, err := NewCrawler(WithMaxDuration(300*time.Millisecond), WithIgnoreRobots(true)).Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Running out of time shouldn't be an error, got %s", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the crawl to stop soon after its time ran out, took %s", time.Since(start))
+	}
+	if sm.StoppedBy != BudgetTime || sm.Interrupted {
+		t.Errorf("Expected the time budget to have stopped the crawl, got %q (interrupted %t)", sm.StoppedBy, sm.Interrupted)
+	}
+}
+
+func TestCrawlerHooks(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	pages := 0
+	var skipped []SkippedURL
+	crawler := NewCrawler(
+		WithDepth(3),
+		OnPage(func(result fetch.JobResult) { pages++ }),
+		OnSkip(func(s SkippedURL) { skipped = append(skipped, s) }),
+	)
+	if _, err := crawler.Crawl(context.Background(), ts.URL+"/"); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	// /, /about, /gone and /deep. /secret is disallowed by robots.txt.
+	if pages != 4 {
+		t.Errorf("Expected 4 pages to be fetched, got %d", pages)
+	}
+	if len(skipped) != 1 || skipped[0].URL != ts.URL+"/secret" {
+		t.Errorf("Expected /secret to be skipped, got %+v", skipped)
+	}
+}
+
+func TestCrawlerLogger(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/broken">Broken</a>`))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	crawler := NewCrawler(WithDepth(2), WithRetries(0), WithIgnoreRobots(true), WithLogger(log.New(&buf, "", 0)))
+	if _, err := crawler.Crawl(context.Background(), ts.URL+"/"); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !strings.Contains(buf.String(), ts.URL+"/broken") {
+		t.Errorf("Expected the failure to be logged to our logger, got %q", buf.String())
+	}
+}
+
+func TestCrawlerNormalizer(t *testing.T) {
+	var mu sync.Mutex
+	requested := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[r.URL.RequestURI()]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/a?utm_source=x">a</a><a href="/a">a</a><a href="/./a#top">a</a><a href="/b?id=2">b</a><a href="/b?id=1">b</a>`))
+	}))
+	defer ts.Close()
+
+	sm, err := NewCrawler(WithDepth(2), WithIgnoreRobots(true)).Crawl(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	for uri, count := range requested {
+		if count > 1 {
+			t.Errorf("%s was requested %d times, should have been once", uri, count)
+		}
+	}
+	for _, uri := range []string{"/", "/a", "/b?id=1", "/b?id=2"} {
+		if requested[uri] != 1 {
+			t.Errorf("Expected %s to be requested once, requests were %v", uri, requested)
+		}
+	}
+	if sm.RootNode.URL.String() != ts.URL+"/" {
+		t.Errorf("The seed should have been normalized to %s/, was %s", ts.URL, sm.RootNode.URL)
+	}
+
+	requested = make(map[string]int)
+	_, err = NewCrawler(WithDepth(2), WithIgnoreRobots(true), WithNormalizer(util.Normalizer{StripQuery: true})).Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if requested["/b"] != 1 || len(requested) != 3 {
+		t.Errorf("Stripping the query should have left /, /a and /b, requests were %v", requested)
+	}
+}
+
+func TestCrawlerOnlyFollowsRedirectsItMayFetch(t *testing.T) {
+	var mu sync.Mutex
+	fetched := make(map[string]bool)
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched["elsewhere"] = true
+		mu.Unlock()
+	}))
+	defer elsewhere.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path] = true
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprint(w, "User-agent: *\nDisallow: /secret\n")
+		case "/":
+			fmt.Fprint(w, `<a href="/away">Away</a><a href="/hidden">Hidden</a>`)
+		case "/away":
+			http.Redirect(w, r, elsewhere.URL+"/", http.StatusFound)
+		case "/hidden":
+			http.Redirect(w, r, "/secret", http.StatusMovedPermanently)
+		default:
+			fmt.Fprint(w, "Nothing to see here")
+		}
+	}))
+	defer ts.Close()
+
+	seedURL, _ := url.Parse(ts.URL + "/")
+	crawler := NewCrawler(WithDepth(2), WithClient(ts.Client()), WithScope(util.NewExactHostScope(seedURL)))
+	sm, err := crawler.Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if fetched["elsewhere"] || fetched["/secret"] {
+		t.Errorf("Redirects out of scope or disallowed by robots.txt shouldn't be followed, fetched %v", fetched)
+	}
+	for path, location := range map[string]string{"/away": elsewhere.URL + "/", "/hidden": ts.URL + "/secret"} {
+		link, _ := url.Parse(ts.URL + path)
+		node, _ := sm.Lookup(link)
+		if node.FetchError != "" || node.FinalURL != "" || len(node.Redirects) != 1 || node.Redirects[0].Location != location {
+			t.Errorf("Expected %s to stop at its redirect to %s, got %+v", path, location, node)
+		}
+	}
+	if len(sm.BrokenLinks()) != 0 {
+		t.Errorf("A redirect we didn't follow isn't broken, got %+v", sm.BrokenLinks())
+	}
+}
@@ -0,0 +1,169 @@
+package sitemap
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+DOTCluster says how the pages in a DOT graph are grouped into boxes.
+*/
+type DOTCluster string
+
+const (
+	// ClusterNone doesn't group the pages at all.
+	ClusterNone DOTCluster = "none"
+	// ClusterByHost puts each host's pages in their own box.
+	ClusterByHost DOTCluster = "host"
+	// ClusterByDepth puts the pages in boxes by how many links they are from
+	// the seed.
+	ClusterByDepth DOTCluster = "depth"
+)
+
+/*
+The colours edges are drawn in, depending on what happened when we fetched the
+page they point to.
+*/
+const (
+	dotColourOK         = "black"
+	dotColourRedirect   = "blue"
+	dotColourBroken     = "red"
+	dotColourServer     = "orange"
+	dotColourNotFetched = "gray"
+)
+
+/*
+DOTOptions controls how a SiteMap is drawn as a Graphviz graph. Cluster is how
+the pages are grouped, and is ClusterByHost if it isn't set.
+*/
+type DOTOptions struct {
+	Cluster DOTCluster
+}
+
+/*
+dotNode is a page in a DOT graph, with the ID it's drawn under.
+*/
+type dotNode struct {
+	id      string
+	node    *Node
+	cluster string
+}
+
+/*
+DOT returns the Sitemap's link graph in Graphviz's DOT language, ready for dot
+or any other graph tool to draw. Every page in the tree is a box labelled with
+its path, and every link between pages is an arrow, coloured by what happened
+when we fetched the page it points to: black for a 2xx, blue if it redirected,
+orange for a 5xx, red for a 4xx or a page that couldn't be loaded, and gray
+if it was never fetched. Pages that are only there because a sitemap.xml
+listed them have dashed boxes. A page linking to another more than once only
+gets one arrow.
+*/
+func (s *SiteMap) DOT(opts DOTOptions) string {
+	if opts.Cluster == "" {
+		opts.Cluster = ClusterByHost
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	output := "digraph sitemap {\n"
+	output = output + "  rankdir=LR;\n"
+	output = output + "  node [shape=box, fontname=\"Helvetica\"];\n"
+	if s.RootNode == nil {
+		return output + "}\n"
+	}
+
+	var nodes []dotNode
+	ids := make(map[*Node]string)
+	var clusters []string
+	clustered := make(map[string][]dotNode)
+	s.RootNode.walkDepth(0, func(node *Node, depth int) {
+		n := dotNode{id: fmt.Sprintf("n%d", len(nodes)), node: node}
+		switch opts.Cluster {
+		case ClusterByHost:
+			n.cluster = node.URL.Host
+		case ClusterByDepth:
+			n.cluster = fmt.Sprintf("depth %d", depth)
+		}
+		if _, ok := clustered[n.cluster]; !ok {
+			clusters = append(clusters, n.cluster)
+		}
+		clustered[n.cluster] = append(clustered[n.cluster], n)
+		nodes = append(nodes, n)
+		ids[node] = n.id
+	})
+
+	for i, cluster := range clusters {
+		indent := "  "
+		if cluster != "" {
+			output = output + fmt.Sprintf("  subgraph cluster_%d {\n", i)
+			output = output + fmt.Sprintf("    label=%s;\n", dotQuote(cluster))
+			indent = "    "
+		}
+		for _, n := range clustered[cluster] {
+			style := ""
+			if n.node.FromSitemap {
+				style = ", style=dashed"
+			}
+			output = output + fmt.Sprintf("%s%s [label=%s, tooltip=%s%s];\n", indent, n.id, dotQuote(dotLabel(n.node)), dotQuote(n.node.URL.String()), style)
+		}
+		if cluster != "" {
+			output = output + "  }\n"
+		}
+	}
+
+	for _, n := range nodes {
+		for _, to := range n.node.linked() {
+			if _, ok := ids[to]; !ok {
+				continue
+			}
+			output = output + fmt.Sprintf("  %s -> %s [color=%s];\n", n.id, ids[to], dotColour(to))
+		}
+	}
+	return output + "}\n"
+}
+
+/*
+dotLabel returns what a page is labelled with in a DOT graph, which is its path
+and query string.
+*/
+func dotLabel(node *Node) string {
+	label := node.URL.EscapedPath()
+	if label == "" {
+		label = "/"
+	}
+	if node.URL.RawQuery != "" {
+		label = label + "?" + node.URL.RawQuery
+	}
+	return label
+}
+
+/*
+dotColour returns the colour of an edge pointing at node.
+*/
+func dotColour(node *Node) string {
+	switch {
+	case node.StatusCode >= 500:
+		// These still count as failed once the retries run out, but it's
+		// worth being able to tell them apart from pages that are gone.
+		return dotColourServer
+	case node.FetchError != "" || node.StatusCode >= 400:
+		return dotColourBroken
+	case node.StatusCode == 0:
+		return dotColourNotFetched
+	case node.FinalURL != "" || len(node.Redirects) > 0:
+		return dotColourRedirect
+	default:
+		return dotColourOK
+	}
+}
+
+/*
+dotQuote returns s as a quoted DOT string.
+*/
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,94 @@
+package sitemap
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kn100/charlotte/fetch"
+)
+
+/*
+dotSiteMap builds a sitemap with a page for every colour of edge, and a link
+off to another host.
+*/
+func dotSiteMap() *SiteMap {
+	return buildSiteMap(&SiteMap{Depth: 3},
+		[]fetch.JobResult{{
+			FromURL:    mustParseURL("https://kn100.me/"),
+			StatusCode: 200,
+			LinksTo:    links(`https://kn100.me/about?q="hi"`, "https://kn100.me/old", "https://kn100.me/gone", "https://kn100.me/down"),
+		}},
+		[]fetch.JobResult{
+			{FromURL: mustParseURL(`https://kn100.me/about?q="hi"`), StatusCode: 200, LinksTo: links("https://kn100.me/", "https://blog.kn100.me/")},
+			{FromURL: mustParseURL("https://kn100.me/old"), FinalURL: mustParseURL("https://kn100.me/new"), StatusCode: 200},
+			{FromURL: mustParseURL("https://kn100.me/gone"), StatusCode: 404},
+			{FromURL: mustParseURL("https://kn100.me/down"), StatusCode: 503, Err: errors.New("server returned 503")},
+		},
+	)
+}
+
+func TestDOT(t *testing.T) {
+	sm := dotSiteMap()
+	expected := `digraph sitemap {
+  rankdir=LR;
+  node [shape=box, fontname="Helvetica"];
+  subgraph cluster_0 {
+    label="kn100.me";
+    n0 [label="/", tooltip="https://kn100.me/"];
+    n1 [label="/about?q=\"hi\"", tooltip="https://kn100.me/about?q=\"hi\""];
+    n3 [label="/old", tooltip="https://kn100.me/old"];
+    n4 [label="/gone", tooltip="https://kn100.me/gone"];
+    n5 [label="/down", tooltip="https://kn100.me/down"];
+  }
+  subgraph cluster_1 {
+    label="blog.kn100.me";
+    n2 [label="/", tooltip="https://blog.kn100.me/"];
+  }
+  n0 -> n1 [color=black];
+  n0 -> n3 [color=blue];
+  n0 -> n4 [color=red];
+  n0 -> n5 [color=orange];
+  n1 -> n0 [color=black];
+  n1 -> n2 [color=gray];
+}
+`
+	if dot := sm.DOT(DOTOptions{}); dot != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, dot)
+	}
+}
+
+func TestDOTClusters(t *testing.T) {
+	sm := dotSiteMap()
+	byDepth := sm.DOT(DOTOptions{Cluster: ClusterByDepth})
+	for _, expected := range []string{`label="depth 0";`, `label="depth 1";`, `label="depth 2";`} {
+		if !strings.Contains(byDepth, expected) {
+			t.Errorf("Expected the graph clustered by depth to contain %s, got:\n%s", expected, byDepth)
+		}
+	}
+	if none := sm.DOT(DOTOptions{Cluster: ClusterNone}); strings.Contains(none, "subgraph") {
+		t.Errorf("Expected no clusters, got:\n%s", none)
+	}
+	empty := &SiteMap{}
+	if dot := empty.DOT(DOTOptions{}); !strings.HasPrefix(dot, "digraph sitemap {") || !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("Expected an empty graph, got:\n%s", dot)
+	}
+}
+
+func TestDOTColour(t *testing.T) {
+	cases := map[string]*Node{
+		dotColourOK:         {StatusCode: 200},
+		dotColourRedirect:   {StatusCode: 200, FinalURL: "https://kn100.me/new"},
+		dotColourBroken:     {StatusCode: 410},
+		dotColourServer:     {StatusCode: 500},
+		dotColourNotFetched: {},
+	}
+	for expected, node := range cases {
+		if got := dotColour(node); got != expected {
+			t.Errorf("Expected %+v to be %s, got %s", node, expected, got)
+		}
+	}
+	if got := dotColour(&Node{FetchError: "connection refused"}); got != dotColourBroken {
+		t.Errorf("A page that couldn't be loaded should be %s, got %s", dotColourBroken, got)
+	}
+}
@@ -0,0 +1,133 @@
+package sitemap
+
+import (
+	"fmt"
+	"net/http"
+)
+
+/*
+InvalidSeedError is returned when the seed we were given isn't a URL we can
+crawl, because it didn't parse or has no host.
+*/
+type InvalidSeedError struct {
+	Seed string
+	Err  error
+}
+
+func (e *InvalidSeedError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%q isn't a URL we can crawl", e.Seed)
+	}
+	return fmt.Sprintf("%q isn't a URL we can crawl: %s", e.Seed, e.Err)
+}
+
+func (e *InvalidSeedError) Unwrap() error {
+	return e.Err
+}
+
+/*
+UnscopedHostError is returned when we can't work out which site the seed
+belongs to, so we'd have no way of telling which links are in scope.
+*/
+type UnscopedHostError struct {
+	Host string
+	Err  error
+}
+
+func (e *UnscopedHostError) Error() string {
+	return fmt.Sprintf("couldn't work out which site %q belongs to: %s", e.Host, e.Err)
+}
+
+func (e *UnscopedHostError) Unwrap() error {
+	return e.Err
+}
+
+/*
+URLError records a page that couldn't be loaded, or that came back with a 4xx
+or 5xx. Err is why it couldn't be loaded, and is nil if the server answered
+with an error status rather than not answering at all.
+*/
+type URLError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *URLError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.URL, e.Err)
+	}
+	return fmt.Sprintf("%s: server returned %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *URLError) Unwrap() error {
+	return e.Err
+}
+
+/*
+SeedFetchError is returned when the crawl couldn't get past the seed, because
+the seed itself couldn't be loaded. Err is the URLError for the seed.
+*/
+type SeedFetchError struct {
+	Err *URLError
+}
+
+func (e *SeedFetchError) Error() string {
+	return fmt.Sprintf("couldn't fetch the seed %s", e.Err)
+}
+
+func (e *SeedFetchError) Unwrap() error {
+	return e.Err
+}
+
+/*
+SeedSkippedError is returned when the crawl couldn't get past the seed because
+we weren't allowed to fetch it, usually because robots.txt disallows it or
+couldn't be fetched. Skipped says which, the same way it's listed in the
+Sitemap's Skipped.
+*/
+type SeedSkippedError struct {
+	Skipped SkippedURL
+}
+
+func (e *SeedSkippedError) Error() string {
+	return fmt.Sprintf("couldn't crawl the seed %s: %s", e.Skipped.URL, e.Skipped.Reason)
+}
+
+/*
+Errors returns a URLError for every page that couldn't be loaded or came back
+with a 4xx or 5xx, in the order we found out about them. Unlike BrokenLinks,
+these carry the original error, so you can errors.Is or errors.As them (for a
+*fetch.StatusError, say, or a context.DeadlineExceeded).
+*/
+func (s *SiteMap) Errors() []*URLError {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	errs := make([]*URLError, len(s.errs))
+	copy(errs, s.errs)
+	return errs
+}
+
+/*
+seedError returns a SeedFetchError if the root node was fetched and failed, a
+SeedSkippedError if we weren't allowed to fetch it, or nil if it was fine (or
+never got as far as being fetched).
+*/
+func (s *SiteMap) seedError() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.RootNode == nil {
+		return nil
+	}
+	for _, urlErr := range s.errs {
+		if urlErr.URL == s.RootNode.URL.String() {
+			return &SeedFetchError{Err: urlErr}
+		}
+	}
+	for _, skipped := range s.Skipped {
+		if skipped.URL == s.RootNode.URL.String() {
+			return &SeedSkippedError{Skipped: skipped}
+		}
+	}
+	return nil
+}
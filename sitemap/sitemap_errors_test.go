@@ -0,0 +1,121 @@
+package sitemap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuild(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	sm, err := Build(context.Background(), ts.URL+"/", 3, time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	errs := sm.Errors()
+	if len(errs) != 1 || errs[0].URL != ts.URL+"/gone" || errs[0].StatusCode != 404 {
+		t.Errorf("Expected /gone to be the only error, got %+v", errs)
+	}
+}
+
+func TestBuildInvalidSeed(t *testing.T) {
+	for _, seed := range []string{"://nope", "just-a-path"} {
+		sm, err := Build(context.Background(), seed, 3, time.Second)
+		var seedErr *InvalidSeedError
+		if !errors.As(err, &seedErr) || seedErr.Seed != seed {
+			t.Errorf("Expected an InvalidSeedError for %q, got %v", seed, err)
+		}
+		if sm != nil {
+			t.Errorf("Expected no sitemap for %q", seed)
+		}
+	}
+}
+
+func TestBuildUnscopedHost(t *testing.T) {
+	_, err := Build(context.Background(), "http://:8080/", 3, time.Second)
+	var hostErr *UnscopedHostError
+	if !errors.As(err, &hostErr) || hostErr.Host != ":8080" {
+		t.Errorf("Expected an UnscopedHostError, got %v", err)
+	}
+}
+
+func TestBuildSeedFetchFailure(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	sm, err := Build(context.Background(), ts.URL+"/", 3, time.Second)
+	var seedErr *SeedFetchError
+	if !errors.As(err, &seedErr) || seedErr.Err.StatusCode != 404 {
+		t.Fatalf("Expected a SeedFetchError, got %v", err)
+	}
+	if sm == nil || sm.RootNode == nil {
+		t.Errorf("Expected the sitemap to still be returned")
+	}
+}
+
+func TestBuildSeedUnreachable(t *testing.T) {
+	// Nothing listens on port 1, so robots.txt can't be fetched either, and
+	// the seed ends up skipped rather than failed.
+	sm, err := Build(context.Background(), "http://127.0.0.1:1/", 3, time.Second)
+	var skippedErr *SeedSkippedError
+	if !errors.As(err, &skippedErr) || skippedErr.Skipped.URL != "http://127.0.0.1:1/" {
+		t.Fatalf("Expected a SeedSkippedError, got %v", err)
+	}
+	if sm == nil || sm.RootNode == nil {
+		t.Errorf("Expected the sitemap to still be returned")
+	}
+
+	_, err = NewCrawler(WithIgnoreRobots(true), WithRetries(0)).Crawl(context.Background(), "http://127.0.0.1:1/")
+	var seedErr *SeedFetchError
+	if !errors.As(err, &seedErr) {
+		t.Errorf("Expected a SeedFetchError without robots.txt, got %v", err)
+	}
+}
+
+func TestBuildSeedDisallowed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow: /\n"))
+			return
+		}
+		w.Write([]byte(`<a href="/about">About</a>`))
+	}))
+	defer ts.Close()
+
+	_, err := Build(context.Background(), ts.URL+"/", 3, time.Second)
+	var skippedErr *SeedSkippedError
+	if !errors.As(err, &skippedErr) || !strings.Contains(skippedErr.Error(), "disallowed by robots.txt") {
+		t.Errorf("Expected a SeedSkippedError, got %v", err)
+	}
+}
+
+func TestBuildInterrupted(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sm, err := Build(ctx, ts.URL+"/", 3, time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if sm == nil || !sm.Interrupted {
+		t.Errorf("Expected an interrupted sitemap, got %+v", sm)
+	}
+}
+
+func TestURLErrorUnwraps(t *testing.T) {
+	urlErr := &URLError{URL: "https://kn100.me/", Err: context.DeadlineExceeded}
+	if !errors.Is(&SeedFetchError{Err: urlErr}, context.DeadlineExceeded) {
+		t.Errorf("Expected SeedFetchError to unwrap to the original error")
+	}
+	if got := (&URLError{URL: "https://kn100.me/", StatusCode: 404}).Error(); got != "https://kn100.me/: server returned 404 Not Found" {
+		t.Errorf("Unexpected error string %q", got)
+	}
+}
@@ -0,0 +1,142 @@
+package sitemap
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/kn100/charlotte/fetch"
+)
+
+/*
+Edge is one link from one page to another. Together, the edges of a Sitemap
+make up the site's actual link graph, where the tree of Nodes only shows the
+first way we found to reach each page. Kind says whether it's a link to
+another page, a resource the page loads, a form or a refresh.
+*/
+type Edge struct {
+	From string         `json:"From"`
+	To   string         `json:"To"`
+	Text string         `json:"Text,omitempty"`
+	Rel  string         `json:"Rel,omitempty"`
+	Kind fetch.LinkKind `json:"Kind,omitempty"`
+}
+
+/*
+AddLink records a link found on the page at from. If the page it points to is
+new, it is added to the tree under from, and AddLink returns true. Either way,
+the link is kept as an Edge. A relative link is taken to be relative to from.
+The page is fetched at the URL s.Normalizer prefers, but the Edge keeps the
+URL as it was written. It returns an error if there is no root node, or from
+isn't in the Sitemap.
+*/
+func (s *SiteMap) AddLink(from *url.URL, link fetch.Link) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RootNode == nil {
+		return false, errors.New("there was no root node set")
+	}
+	// The fetcher hands us absolute links, but anyone else might not, and a
+	// relative link is relative to the page it was on.
+	to := link.URL
+	if !to.IsAbs() {
+		to = from.ResolveReference(to)
+	}
+
+	fromNode, seenFromURLBefore := s.index[s.key(from)]
+	if !seenFromURLBefore {
+		errText := fmt.Sprintf("from node %s is not in sitemap", from.String())
+		return false, errors.New(errText)
+	}
+	s.addEdge(Edge{From: from.String(), To: to.String(), Text: link.Text, Rel: link.Rel, Kind: link.Kind})
+
+	toNode, seenToURLBefore := s.index[s.key(to)]
+	if seenToURLBefore {
+		// We've already got this in the tree, so just note the link.
+		fromNode.AddLink(toNode)
+		return false, nil
+	}
+
+	// Fresh, unseen URL. Create the Node and add it to the sitemap
+	newNode := Node{
+		URL:       s.normalizer().Preferred(to),
+		CreatedAt: time.Now().Unix(),
+	}
+	fromNode.AddLeaf(&newNode)
+	s.indexNode(&newNode)
+	return true, nil
+}
+
+/*
+addEdge adds an edge to the graph, unless we already have an identical one.
+The caller must hold s.mu for writing.
+*/
+func (s *SiteMap) addEdge(edge Edge) {
+	if s.edgeSet == nil {
+		s.edgeSet = make(map[Edge]bool)
+		s.edgesByTarget = make(map[string][]int)
+	}
+	if s.edgeSet[edge] {
+		return
+	}
+	s.edgeSet[edge] = true
+	key := s.keyOf(edge.To)
+	s.edgesByTarget[key] = append(s.edgesByTarget[key], len(s.Edges))
+	s.Edges = append(s.Edges, edge)
+}
+
+/*
+edgesTo returns every edge pointing at the given URL, or any other way of
+writing it that s.Normalizer says is the same page, in the order they were
+found. The caller must hold s.mu.
+*/
+func (s *SiteMap) edgesTo(to string) []Edge {
+	var edges []Edge
+	for _, i := range s.edgesByTarget[s.keyOf(to)] {
+		edges = append(edges, s.Edges[i])
+	}
+	return edges
+}
+
+/*
+reachable returns every node that can be got to by following edges from the
+root. The caller must hold s.mu.
+*/
+func (s *SiteMap) reachable() map[*Node]bool {
+	linksFrom := make(map[*Node][]*Node)
+	for _, edge := range s.Edges {
+		from, ok := s.index[s.keyOf(edge.From)]
+		if !ok {
+			continue
+		}
+		if to, ok := s.index[s.keyOf(edge.To)]; ok {
+			linksFrom[from] = append(linksFrom[from], to)
+		}
+	}
+	reached := map[*Node]bool{s.RootNode: true}
+	queue := []*Node{s.RootNode}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, to := range linksFrom[node] {
+			if !reached[to] {
+				reached[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+	return reached
+}
+
+/*
+keyOf is key for a URL we only have as a string. Anything that won't parse is
+its own key.
+*/
+func (s *SiteMap) keyOf(raw string) string {
+	link, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return s.key(link)
+}
@@ -0,0 +1,146 @@
+package sitemap
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kn100/charlotte/fetch"
+)
+
+/*
+cyclicSiteMap builds kn100.me/ -> /about -> /about/kevin, where /about/kevin
+links back to / and across to /test, and / also links to /test.
+*/
+func cyclicSiteMap() *SiteMap {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	aboutURL, _ := url.Parse("https://kn100.me/about")
+	kevinURL, _ := url.Parse("https://kn100.me/about/kevin")
+	testURL, _ := url.Parse("https://kn100.me/test")
+	sm := &SiteMap{Depth: 3}
+	sm.SetRootNode(baseURL)
+	sm.AddLink(baseURL, fetch.Link{URL: aboutURL, Text: "About"})
+	sm.AddLink(aboutURL, fetch.Link{URL: kevinURL, Text: "Kevin"})
+	sm.AddLink(kevinURL, fetch.Link{URL: baseURL, Text: "Home", Rel: "home"})
+	sm.AddLink(kevinURL, fetch.Link{URL: testURL, Text: "Test"})
+	sm.AddLink(baseURL, fetch.Link{URL: testURL, Text: "Test"})
+	return sm
+}
+
+func TestStringMarksBackReferences(t *testing.T) {
+	sm := cyclicSiteMap()
+	expected := `https://kn100.me/
+  https://kn100.me/about
+    https://kn100.me/about/kevin
+      ↩ https://kn100.me/ (already shown)
+      https://kn100.me/test
+  ↩ https://kn100.me/test (already shown)
+`
+	actual := sm.String()
+	if actual != expected {
+		t.Errorf("The string output did not match what was expected.\n Expected: \n %s\n Actual:\n %s\n", expected, actual)
+	}
+}
+
+func TestStringMarksForwardReferences(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	aboutURL, _ := url.Parse("https://kn100.me/about")
+	testURL, _ := url.Parse("https://kn100.me/test")
+	sm := &SiteMap{Depth: 2}
+	sm.SetRootNode(baseURL)
+	sm.AddLeaf(baseURL, aboutURL)
+	sm.AddLeaf(baseURL, testURL)
+	// /about was added first, so it is printed before /test is.
+	sm.AddLeaf(aboutURL, testURL)
+	expected := `https://kn100.me/
+  https://kn100.me/about
+    ↪ https://kn100.me/test (shown later)
+  https://kn100.me/test
+`
+	actual := sm.String()
+	if actual != expected {
+		t.Errorf("The string output did not match what was expected.\n Expected: \n %s\n Actual:\n %s\n", expected, actual)
+	}
+}
+
+func TestAddLinkRecordsEveryEdge(t *testing.T) {
+	sm := cyclicSiteMap()
+	if len(sm.Edges) != 5 {
+		t.Fatalf("Expected 5 edges, got %d", len(sm.Edges))
+	}
+	backLink := Edge{From: "https://kn100.me/about/kevin", To: "https://kn100.me/", Text: "Home", Rel: "home"}
+	if sm.Edges[2] != backLink {
+		t.Errorf("Expected the third edge to be %+v, got %+v", backLink, sm.Edges[2])
+	}
+
+	// The same link again shouldn't add another edge.
+	baseURL, _ := url.Parse("https://kn100.me/")
+	testURL, _ := url.Parse("https://kn100.me/test")
+	sm.AddLink(baseURL, fetch.Link{URL: testURL, Text: "Test"})
+	if len(sm.Edges) != 5 {
+		t.Errorf("Expected a duplicate link not to add an edge, got %d edges", len(sm.Edges))
+	}
+}
+
+func TestEdgesToMatchesEveryWayOfWritingAPage(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	aboutURL, _ := url.Parse("https://kn100.me/about")
+	insecureAbout, _ := url.Parse("http://kn100.me/about")
+	sm := SiteMap{}
+	sm.SetRootNode(baseURL)
+	sm.AddLeaf(baseURL, aboutURL)
+	sm.AddLink(baseURL, fetch.Link{URL: aboutURL, Text: "About"})
+	sm.AddLink(aboutURL, fetch.Link{URL: insecureAbout, Text: "Me"})
+	sm.AddLink(aboutURL, fetch.Link{URL: baseURL, Text: "Home"})
+	if edges := sm.edgesTo("http://kn100.me/about"); len(edges) != 3 {
+		t.Errorf("Expected 3 edges to /about over either scheme, got %+v", edges)
+	}
+	if edges := sm.edgesTo("https://kn100.me/"); len(edges) != 1 || edges[0].Text != "Home" {
+		t.Errorf("Expected the one edge back home, got %+v", edges)
+	}
+	if edges := sm.edgesTo("https://kn100.me/nowhere"); len(edges) != 0 {
+		t.Errorf("Expected no edges to a page nothing links to, got %+v", edges)
+	}
+}
+
+func TestAddLinkResolvesAgainstFrom(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	postURL, _ := url.Parse("https://kn100.me/blog/post/")
+	relative, _ := url.Parse("../about")
+	sm := SiteMap{}
+	sm.SetRootNode(baseURL)
+	sm.AddLeaf(baseURL, postURL)
+	sm.AddLink(postURL, fetch.Link{URL: relative})
+	aboutURL, _ := url.Parse("https://kn100.me/blog/about")
+	if _, ok := sm.Lookup(aboutURL); !ok {
+		t.Errorf("Expected ../about on /blog/post/ to be %s, got %+v", aboutURL, sm.Edges)
+	}
+}
+
+func TestAddLinkRecordsKind(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	imageURL, _ := url.Parse("https://kn100.me/me.png")
+	sm := SiteMap{}
+	sm.SetRootNode(baseURL)
+	sm.AddLink(baseURL, fetch.Link{URL: imageURL, Text: "Me", Kind: fetch.KindResource})
+	if len(sm.Edges) != 1 || sm.Edges[0].Kind != fetch.KindResource {
+		t.Errorf("Expected the edge to be a resource, got %+v", sm.Edges)
+	}
+	if !strings.Contains(sm.JSON(), `"Kind":"resource"`) {
+		t.Errorf("Expected the kind to be in the JSON, got %s", sm.JSON())
+	}
+}
+
+func TestJSONWithCycles(t *testing.T) {
+	sm := cyclicSiteMap()
+	var decoded struct {
+		Edges []Edge
+	}
+	if err := json.Unmarshal([]byte(sm.JSON()), &decoded); err != nil {
+		t.Fatalf("Couldn't decode the JSON output. Err: %s", err)
+	}
+	if len(decoded.Edges) != 5 {
+		t.Errorf("Expected 5 edges in the JSON, got %d", len(decoded.Edges))
+	}
+}
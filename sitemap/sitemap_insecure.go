@@ -0,0 +1,87 @@
+package sitemap
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+/*
+InsecureLink is a plain http URL that https pages link to, along with every
+https page we found linking to it.
+*/
+type InsecureLink struct {
+	URL        string     `json:"URL"`
+	LinkedFrom []Referrer `json:"LinkedFrom"`
+}
+
+/*
+InsecureLinks returns every link from an https page to a plain http one, grouped
+by where they go, in the order they were found. A page counts as https if
+that's where it was served from, after any redirects, whichever way it was
+linked to. Even if the http page just redirects to the https one, following
+the link sends the visitor over plain http for a moment, and browsers may warn
+about it.
+*/
+func (s *SiteMap) InsecureLinks() []InsecureLink {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var insecure []InsecureLink
+	found := make(map[string]int)
+	for _, edge := range s.Edges {
+		if !s.isInsecureEdge(edge) {
+			continue
+		}
+		i, ok := found[edge.To]
+		if !ok {
+			i = len(insecure)
+			found[edge.To] = i
+			insecure = append(insecure, InsecureLink{URL: edge.To})
+		}
+		insecure[i].LinkedFrom = append(insecure[i].LinkedFrom, Referrer{URL: edge.From, Text: edge.Text})
+	}
+	return insecure
+}
+
+/*
+InsecureLinksReport returns a human readable list of the plain http URLs that
+https pages link to, each followed by the pages linking to it.
+*/
+func (s *SiteMap) InsecureLinksReport() string {
+	insecure := s.InsecureLinks()
+	if len(insecure) == 0 {
+		return "No https pages link to plain http ones.\n"
+	}
+	indent := strings.Repeat(" ", IndentSpaces)
+	output := ""
+	for _, link := range insecure {
+		output = output + link.URL + "\n"
+		for _, r := range link.LinkedFrom {
+			output = output + fmt.Sprintf("%slinked from %s (%q)\n", indent, r.URL, r.Text)
+		}
+	}
+	return output
+}
+
+/*
+isInsecureEdge returns whether edge goes from a page served over https to an
+http URL. The caller must hold s.mu.
+*/
+func (s *SiteMap) isInsecureEdge(edge Edge) bool {
+	to, err := url.Parse(edge.To)
+	if err != nil || !strings.EqualFold(to.Scheme, "http") {
+		return false
+	}
+	from, err := url.Parse(edge.From)
+	if err != nil {
+		return false
+	}
+	// Edges keep the page's URL as it was first linked to, which needn't be
+	// where it was served from.
+	if node, ok := s.index[s.key(from)]; ok && node.FinalURL != "" {
+		if served, err := url.Parse(node.FinalURL); err == nil {
+			from = served
+		}
+	}
+	return strings.EqualFold(from.Scheme, "https")
+}
@@ -0,0 +1,84 @@
+package sitemap
+
+import (
+	"testing"
+
+	"github.com/kn100/charlotte/fetch"
+	"github.com/kn100/charlotte/util"
+)
+
+/*
+mixedSchemeSiteMap builds a sitemap where the https home page links to the
+about page over both http and https.
+*/
+func mixedSchemeSiteMap(policy util.SchemePolicy) *SiteMap {
+	normalizer := util.DefaultNormalizer()
+	normalizer.Schemes = policy
+	return buildSiteMap(&SiteMap{Depth: 2, Normalizer: &normalizer}, []fetch.JobResult{{
+		FromURL:    mustParseURL("https://kn100.me/"),
+		StatusCode: 200,
+		LinksTo: []fetch.Link{
+			{URL: mustParseURL("http://kn100.me/about"), Text: "About"},
+			{URL: mustParseURL("https://kn100.me/about"), Text: "About me"},
+		},
+	}})
+}
+
+func TestSchemePolicies(t *testing.T) {
+	cases := []struct {
+		policy   util.SchemePolicy
+		children int
+		url      string
+	}{
+		{util.KeepSchemes, 2, "http://kn100.me/about"},
+		{util.MergeSchemes, 1, "http://kn100.me/about"},
+		{util.PreferHTTPS, 1, "https://kn100.me/about"},
+	}
+	for _, c := range cases {
+		sm := mixedSchemeSiteMap(c.policy)
+		if len(sm.RootNode.LinksTo) != c.children {
+			t.Errorf("Policy %d: expected %d pages under the root, got %d", c.policy, c.children, len(sm.RootNode.LinksTo))
+			continue
+		}
+		if got := sm.RootNode.LinksTo[0].URL.String(); got != c.url {
+			t.Errorf("Policy %d: expected the about page to be fetched at %s, got %s", c.policy, c.url, got)
+		}
+		if len(sm.Edges) != 2 {
+			t.Errorf("Policy %d: both links should have been kept as edges, got %v", c.policy, sm.Edges)
+		}
+	}
+}
+
+func TestInsecureLinks(t *testing.T) {
+	sm := mixedSchemeSiteMap(util.PreferHTTPS)
+	insecure := sm.InsecureLinks()
+	if len(insecure) != 1 {
+		t.Fatalf("Expected 1 insecure link, got %v", insecure)
+	}
+	if insecure[0].URL != "http://kn100.me/about" || len(insecure[0].LinkedFrom) != 1 || insecure[0].LinkedFrom[0].URL != "https://kn100.me/" {
+		t.Errorf("Expected http://kn100.me/about linked from the home page, got %v", insecure[0])
+	}
+	expected := "http://kn100.me/about\n  linked from https://kn100.me/ (\"About\")\n"
+	if report := sm.InsecureLinksReport(); report != expected {
+		t.Errorf("Expected report:\n%s\ngot:\n%s", expected, report)
+	}
+
+	empty := &SiteMap{}
+	if report := empty.InsecureLinksReport(); report != "No https pages link to plain http ones.\n" {
+		t.Errorf("Unexpected report for a sitemap with no insecure links: %q", report)
+	}
+}
+
+func TestInsecureLinksFromRedirectedPages(t *testing.T) {
+	sm := buildSiteMap(&SiteMap{Depth: 2}, []fetch.JobResult{{
+		FromURL:    mustParseURL("http://kn100.me/"),
+		FinalURL:   mustParseURL("https://kn100.me/"),
+		StatusCode: 200,
+		LinksTo:    []fetch.Link{{URL: mustParseURL("http://kn100.me/about"), Text: "About"}},
+	}})
+
+	insecure := sm.InsecureLinks()
+	if len(insecure) != 1 || insecure[0].URL != "http://kn100.me/about" {
+		t.Errorf("Expected the link from the page served over https to be insecure, got %v", insecure)
+	}
+}
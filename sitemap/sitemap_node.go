@@ -3,34 +3,169 @@ package sitemap
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/kn100/charlotte/fetch"
 )
 
 /*
 Node stores metadata about a given link as well as a slice pointing to
-SiteMapNodes that it links to.
+SiteMapNodes that it links to. The response fields are only filled in once the
+page has been fetched, so they are empty for pages at the edge of the crawl.
 */
 type Node struct {
 	URL       *url.URL `json:"URL"`
 	CreatedAt int64    `json:"CreatedAt"`
-	LinksTo   []*Node  `json:"LinksTo"`
+	// LinksTo only holds the nodes first discovered from this one, so
+	// following it gives a tree.
+	LinksTo    []*Node `json:"LinksTo"`
+	StatusCode int     `json:"StatusCode,omitempty"`
+	// FinalURL is only set if we were redirected somewhere else, and
+	// Redirects has every hop it took to get there. If a redirect pointed
+	// somewhere we aren't allowed to crawl, we stop at that hop and FinalURL
+	// is left empty.
+	FinalURL      string           `json:"FinalURL,omitempty"`
+	Redirects     []fetch.Redirect `json:"Redirects,omitempty"`
+	ContentType   string           `json:"ContentType,omitempty"`
+	ContentLength int64            `json:"ContentLength,omitempty"`
+	// Truncated is set if the page was too big to read all of.
+	Truncated bool `json:"Truncated,omitempty"`
+	// LastModified is when the server said the page last changed, in seconds
+	// since the epoch like CreatedAt, or 0 if it didn't say.
+	LastModified int64         `json:"LastModified,omitempty"`
+	ResponseTime time.Duration `json:"ResponseTime,omitempty"`
+	// FetchError is set if the page couldn't be loaded, in which case we
+	// don't know what it links to.
+	FetchError string `json:"FetchError,omitempty"`
+	// ReadError is set if the page loaded, but the connection broke before
+	// we had read all of it. It isn't broken, but it may link to more than
+	// we found.
+	ReadError string `json:"ReadError,omitempty"`
+	// FromSitemap is set if the page is only in the tree because a
+	// sitemap.xml listed it, in which case it hangs off the root without the
+	// root linking to it.
+	FromSitemap bool `json:"FromSitemap,omitempty"`
+
+	parent *Node
+	// outbound is every page this one links to, including ones that were
+	// already in the tree.
+	outbound []*Node
 }
 
 /*
 String returns a readable representation of this node and all it links to
-recursively. It hides the initial depth value used for recursion from the
-consumer. Just a bit nicer to work with!
+recursively. Links to pages that appear elsewhere in the tree are shown as
+references rather than being followed, which is what stops cycles looping
+forever. It hides the initial depth value and the record of what's been shown
+used for recursion from the consumer. Just a bit nicer to work with!
 */
 func (s *Node) String() string {
-	return s.string(0)
+	return s.string(0, make(map[*Node]bool))
 }
 
-func (s *Node) string(depth int) string {
+func (s *Node) string(depth int, shown map[*Node]bool) string {
 	output := ""
-	output = output + fmt.Sprintf("%s%s\n", s.indent(depth), s.URL)
+	output = output + fmt.Sprintf("%s%s%s\n", s.indent(depth), s.URL, s.describe())
+	shown[s] = true
 	depth++
+	for _, node := range s.links() {
+		switch {
+		case shown[node]:
+			output = output + fmt.Sprintf("%s↩ %s (already shown)\n", s.indent(depth), node.URL)
+		case node.parent != s && node.parent != nil:
+			output = output + fmt.Sprintf("%s↪ %s (shown later)\n", s.indent(depth), node.URL)
+		default:
+			output = output + node.string(depth, shown)
+		}
+	}
+	return output
+}
+
+/*
+links returns every node this one links to, in the order they were found,
+followed by any pages a sitemap.xml hung off it. Nodes put together by hand
+with only LinksTo set just return LinksTo.
+*/
+func (s *Node) links() []*Node {
+	if len(s.outbound) == 0 {
+		return s.LinksTo
+	}
+	links := s.outbound
+	for _, node := range s.LinksTo {
+		if node.FromSitemap && !s.linksTo(node) {
+			links = append(links[:len(links):len(links)], node)
+		}
+	}
+	return links
+}
+
+/*
+linked returns every node this one actually links to, leaving out anything a
+sitemap.xml hung off it.
+*/
+func (s *Node) linked() []*Node {
+	if len(s.outbound) > 0 {
+		return s.outbound
+	}
+	var linked []*Node
 	for _, node := range s.LinksTo {
-		output = output + node.string(depth)
+		if !node.FromSitemap {
+			linked = append(linked, node)
+		}
+	}
+	return linked
+}
+
+/*
+linksTo returns whether this node links to node.
+*/
+func (s *Node) linksTo(node *Node) bool {
+	for _, linked := range s.outbound {
+		if linked == node {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+describe returns what we know about the response for this node, ready to be
+tacked onto the end of its line. It is empty if the node was never fetched.
+*/
+func (s *Node) describe() string {
+	var parts []string
+	if s.StatusCode != 0 {
+		parts = append(parts, strconv.Itoa(s.StatusCode))
+	}
+	if s.ContentType != "" {
+		parts = append(parts, s.ContentType)
+	}
+	if s.StatusCode != 0 {
+		parts = append(parts, fmt.Sprintf("%dB", s.ContentLength))
+	}
+	if s.ResponseTime != 0 {
+		parts = append(parts, s.ResponseTime.Round(time.Millisecond).String())
+	}
+	if s.Truncated {
+		parts = append(parts, "truncated")
+	}
+	output := ""
+	if len(parts) > 0 {
+		output = " [" + strings.Join(parts, " ") + "]"
+	}
+	if s.FinalURL != "" {
+		output = output + " -> " + s.FinalURL
+	}
+	if s.FetchError != "" {
+		output = output + fmt.Sprintf(" (failed: %s)", s.FetchError)
+	}
+	if s.ReadError != "" {
+		output = output + fmt.Sprintf(" (cut short: %s)", s.ReadError)
+	}
+	if s.FromSitemap {
+		output = output + " (from sitemap.xml)"
 	}
 	return output
 }
@@ -40,6 +175,39 @@ AddLeaf adds a leaf to this node (a link that is traversable from this node)
 */
 func (s *Node) AddLeaf(siteMapNode *Node) {
 	s.LinksTo = append(s.LinksTo, siteMapNode)
+	siteMapNode.parent = s
+	s.AddLink(siteMapNode)
+}
+
+/*
+AddLink records that this node links to siteMapNode, which is already
+somewhere in the tree. Linking to the same node twice only counts once.
+*/
+func (s *Node) AddLink(siteMapNode *Node) {
+	if s.linksTo(siteMapNode) {
+		return
+	}
+	s.outbound = append(s.outbound, siteMapNode)
+}
+
+/*
+walk calls visit for this node and then everything it links to, depth first.
+*/
+func (s *Node) walk(visit func(*Node)) {
+	s.walkDepth(0, func(node *Node, depth int) {
+		visit(node)
+	})
+}
+
+/*
+walkDepth is walk, but also tells visit how far down the tree each node is,
+counting this one as depth.
+*/
+func (s *Node) walkDepth(depth int, visit func(*Node, int)) {
+	visit(s, depth)
+	for _, node := range s.LinksTo {
+		node.walkDepth(depth+1, visit)
+	}
 }
 
 /*
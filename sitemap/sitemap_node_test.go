@@ -3,6 +3,7 @@ package sitemap
 import (
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestString(t *testing.T) {
@@ -30,3 +31,19 @@ func TestString(t *testing.T) {
 	}
 
 }
+
+func TestStringWithResponse(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	leafURL, _ := url.Parse("https://kn100.me/gone")
+	root := Node{URL: baseURL, StatusCode: 200, ContentType: "text/html", ContentLength: 512, ResponseTime: 12 * time.Millisecond}
+	leaf := Node{URL: leafURL, StatusCode: 503, FetchError: "server returned 503 Service Unavailable"}
+	root.AddLeaf(&leaf)
+
+	expected := `https://kn100.me/ [200 text/html 512B 12ms]
+  https://kn100.me/gone [503 0B] (failed: server returned 503 Service Unavailable)
+`
+	actual := root.String()
+	if actual != expected {
+		t.Errorf("The string output did not match what was expected.\n Expected: \n %s\n Actual:\n %s\n", expected, actual)
+	}
+}
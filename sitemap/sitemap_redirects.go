@@ -0,0 +1,83 @@
+package sitemap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kn100/charlotte/fetch"
+)
+
+/*
+RedirectedPage is a page that nothing links to directly. The only way we found
+to it was through the redirect chains in Chains.
+*/
+type RedirectedPage struct {
+	URL    string             `json:"URL"`
+	Chains [][]fetch.Redirect `json:"Chains"`
+}
+
+/*
+RedirectOnlyPages returns every page we only reached by being redirected to
+it, in the order they appear in the tree. These are worth a look, since every
+link to them costs a visitor an extra round trip.
+*/
+func (s *SiteMap) RedirectOnlyPages() []RedirectedPage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var pages []RedirectedPage
+	if s.RootNode == nil {
+		return pages
+	}
+	found := make(map[string]int)
+	s.RootNode.walk(func(node *Node) {
+		if node.FinalURL == "" || node.FetchError != "" {
+			return
+		}
+		if len(s.edgesTo(node.FinalURL)) > 0 {
+			return
+		}
+		i, ok := found[node.FinalURL]
+		if !ok {
+			i = len(pages)
+			found[node.FinalURL] = i
+			pages = append(pages, RedirectedPage{URL: node.FinalURL})
+		}
+		pages[i].Chains = append(pages[i].Chains, node.Redirects)
+	})
+	return pages
+}
+
+/*
+RedirectsReport returns a human readable list of the pages only reached
+through redirects, each followed by the chains that lead to it.
+*/
+func (s *SiteMap) RedirectsReport() string {
+	pages := s.RedirectOnlyPages()
+	if len(pages) == 0 {
+		return "No pages are only reached through redirects.\n"
+	}
+	indent := strings.Repeat(" ", IndentSpaces)
+	output := ""
+	for _, page := range pages {
+		output = output + page.URL + "\n"
+		for _, chain := range page.Chains {
+			output = output + indent + formatChain(chain) + "\n"
+		}
+	}
+	return output
+}
+
+/*
+formatChain returns a redirect chain as a single line, like
+"/old -301-> /newer -302-> /newest".
+*/
+func formatChain(chain []fetch.Redirect) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	output := chain[0].URL
+	for _, hop := range chain {
+		output = output + fmt.Sprintf(" -%d-> %s", hop.StatusCode, hop.Location)
+	}
+	return output
+}
@@ -0,0 +1,75 @@
+package sitemap
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+/*
+redirectSite serves / linking to /old and /moved. /old redirects to /new,
+which is only linked to from /moved, and /moved redirects twice to /hidden,
+which nothing links to at all.
+*/
+func redirectSite() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/old">Old</a><a href="/moved">Moved</a>`)
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		case "/moved":
+			http.Redirect(w, r, "/moved-again", http.StatusFound)
+		case "/moved-again":
+			http.Redirect(w, r, "/hidden", http.StatusFound)
+		case "/hidden":
+			fmt.Fprint(w, `<a href="/new">New</a>`)
+		default:
+			fmt.Fprint(w, `Nothing to see here`)
+		}
+	}))
+}
+
+func TestRedirectsAreRecorded(t *testing.T) {
+	ts := redirectSite()
+	defer ts.Close()
+
+	sm := MakeSiteMap(ts.URL+"/", 3, time.Second)
+	oldURL, _ := url.Parse(ts.URL + "/old")
+	newURL, _ := url.Parse(ts.URL + "/new")
+	oldNode, _ := sm.Lookup(oldURL)
+	if oldNode == nil || len(oldNode.Redirects) != 1 || oldNode.FinalURL != ts.URL+"/new" {
+		t.Fatalf("Expected /old to record its redirect, got %+v", oldNode)
+	}
+	if newNode, _ := sm.Lookup(newURL); newNode != oldNode {
+		t.Errorf("Expected /new to be the same page as /old, rather than a new one")
+	}
+}
+
+func TestRedirectOnlyPages(t *testing.T) {
+	ts := redirectSite()
+	defer ts.Close()
+
+	sm := MakeSiteMap(ts.URL+"/", 3, time.Second)
+	pages := sm.RedirectOnlyPages()
+	if len(pages) != 1 || pages[0].URL != ts.URL+"/hidden" || len(pages[0].Chains) != 1 || len(pages[0].Chains[0]) != 2 {
+		t.Fatalf("Expected only /hidden to be reached through redirects alone, got %+v", pages)
+	}
+	expected := fmt.Sprintf("%[1]s/hidden\n  %[1]s/moved -302-> %[1]s/moved-again -302-> %[1]s/hidden\n", ts.URL)
+	if actual := sm.RedirectsReport(); actual != expected {
+		t.Errorf("Expected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestNoRedirectOnlyPages(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	sm := MakeSiteMap(ts.URL+"/", 3, time.Second)
+	if actual := sm.RedirectsReport(); actual != "No pages are only reached through redirects.\n" {
+		t.Errorf("Expected no redirect only pages, got %s", actual)
+	}
+}
@@ -0,0 +1,222 @@
+package sitemap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kn100/charlotte/fetch"
+	"github.com/kn100/charlotte/robots"
+)
+
+/*
+maxSitemapFiles is the most sitemap.xml files we'll read for one crawl, sitemap
+indexes included, so a site with an enormous index can't keep us busy forever.
+*/
+const maxSitemapFiles = 100
+
+/*
+sitemapDocument is a sitemap.xml file, which is either a <urlset> of pages or a
+<sitemapindex> of more sitemap files.
+*/
+type sitemapDocument struct {
+	XMLName  xml.Name
+	URLs     []xmlURL     `xml:"url"`
+	Sitemaps []xmlSitemap `xml:"sitemap"`
+}
+
+/*
+ListedPage is a page listed in one of the site's sitemap.xml files. Linked is
+set if we can get to it by following links from the root, so a visitor could
+get to it without the sitemap.
+*/
+type ListedPage struct {
+	URL    string `json:"URL"`
+	Linked bool   `json:"Linked"`
+}
+
+/*
+addSitemapSeeds reads the site's sitemap.xml files, and adds every page they
+list that's in scope to the tree, under the root, so it gets crawled even if
+nothing links to it. The files are /sitemap.xml and any listed on Sitemap
+lines in robots.txt, unless robots.txt is being ignored.
+*/
+func (c *Crawler) addSitemapSeeds(ctx context.Context, client *http.Client, sm *SiteMap, robotsCache *robots.Cache, opts fetch.Options) {
+	root := sm.RootNode.URL
+	var queue []string
+	if robotsCache != nil {
+		queue = append(queue, robotsCache.Get(ctx, root).Sitemaps...)
+	}
+	queue = append(queue, root.ResolveReference(&url.URL{Path: "/sitemap.xml"}).String())
+
+	normalizer := sm.normalizer()
+	read := make(map[string]bool)
+	for len(queue) > 0 && len(read) < maxSitemapFiles && ctx.Err() == nil {
+		raw := strings.TrimSpace(queue[0])
+		queue = queue[1:]
+		link, err := url.Parse(raw)
+		if err != nil || !link.IsAbs() || read[link.String()] {
+			continue
+		}
+		read[link.String()] = true
+		if robotsCache != nil {
+			if ok, reason := robotsCache.Check(ctx, link); !ok {
+				c.skip(sm, SkippedURL{URL: link.String(), Reason: reason})
+				continue
+			}
+		}
+		document, err := readSitemap(ctx, client, link, opts)
+		if err != nil {
+			sm.logger().Printf("Couldn't read sitemap %s. Err: %s\n", link, err)
+			continue
+		}
+		sm.mu.Lock()
+		sm.SitemapFiles = append(sm.SitemapFiles, link.String())
+		sm.mu.Unlock()
+		for _, child := range document.Sitemaps {
+			// An index's entries are relative to nothing, but be generous.
+			if childURL, err := link.Parse(strings.TrimSpace(child.Loc)); err == nil {
+				queue = append(queue, childURL.String())
+			}
+		}
+		for _, entry := range document.URLs {
+			page, err := link.Parse(strings.TrimSpace(entry.Loc))
+			if err != nil || (page.Scheme != "http" && page.Scheme != "https") {
+				continue
+			}
+			normalizer.Normalize(page)
+			if !sm.Scope.InScope(page) {
+				continue
+			}
+			sm.addListed(page)
+		}
+	}
+}
+
+/*
+readSitemap fetches and parses one sitemap.xml file, just like a page is
+fetched, so it keeps to the same per host limits, delays and retries. Gzipped
+files are unzipped, whatever their name or Content-Type says.
+*/
+func readSitemap(ctx context.Context, client *http.Client, link *url.URL, opts fetch.Options) (sitemapDocument, error) {
+	var document sitemapDocument
+	resp, err := fetch.Get(ctx, client, link, opts)
+	if err != nil {
+		return document, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return document, &fetch.StatusError{StatusCode: resp.StatusCode}
+	}
+
+	body := bufio.NewReader(resp.Body)
+	var content io.Reader = body
+	if magic, _ := body.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipped, err := gzip.NewReader(body)
+		if err != nil {
+			return document, err
+		}
+		defer unzipped.Close()
+		content = unzipped
+	}
+	data, err := io.ReadAll(io.LimitReader(content, int64(MaxXMLBytes)+1))
+	if err != nil {
+		return document, err
+	}
+	if len(data) > MaxXMLBytes {
+		return document, fmt.Errorf("it's bigger than the %d bytes a sitemap is allowed to be", MaxXMLBytes)
+	}
+	if err := xml.Unmarshal(data, &document); err != nil {
+		return document, err
+	}
+	if document.XMLName.Local != "urlset" && document.XMLName.Local != "sitemapindex" {
+		return document, fmt.Errorf("expected a <urlset> or <sitemapindex>, got <%s>", document.XMLName.Local)
+	}
+	return document, nil
+}
+
+/*
+addListed records that a sitemap.xml listed link, and adds it to the tree
+under the root if it isn't there already.
+*/
+func (s *SiteMap) addListed(link *url.URL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listedSet == nil {
+		s.listedSet = make(map[string]bool)
+	}
+	if s.listedSet[s.key(link)] {
+		return
+	}
+	s.listedSet[s.key(link)] = true
+	s.Listed = append(s.Listed, link.String())
+	if _, ok := s.index[s.key(link)]; ok {
+		return
+	}
+	node := &Node{
+		URL:         s.normalizer().Preferred(link),
+		CreatedAt:   s.RootNode.CreatedAt,
+		FromSitemap: true,
+		parent:      s.RootNode,
+	}
+	// This isn't a link, so it only goes in the tree, not in outbound.
+	s.RootNode.LinksTo = append(s.RootNode.LinksTo, node)
+	s.indexNode(node)
+}
+
+/*
+ListedPages returns every page listed in the site's sitemap.xml files, and
+whether it can be reached by following links from the root. A page only
+linked to from other pages nothing links to doesn't count.
+*/
+func (s *SiteMap) ListedPages() []ListedPage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var pages []ListedPage
+	reached := s.reachable()
+	for _, listed := range s.Listed {
+		page := ListedPage{URL: listed}
+		if link, err := url.Parse(listed); err == nil {
+			node, ok := s.index[s.key(link)]
+			page.Linked = ok && reached[node]
+		}
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+/*
+ListedPagesReport returns a human readable list of the pages in the site's
+sitemap.xml files, split into the ones nothing links to and the ones something
+does.
+*/
+func (s *SiteMap) ListedPagesReport() string {
+	pages := s.ListedPages()
+	if len(pages) == 0 {
+		return "No pages were listed in a sitemap.xml.\n"
+	}
+	indent := strings.Repeat(" ", IndentSpaces)
+	unlinked := ""
+	linked := ""
+	for _, page := range pages {
+		if page.Linked {
+			linked = linked + indent + page.URL + "\n"
+		} else {
+			unlinked = unlinked + indent + page.URL + "\n"
+		}
+	}
+	output := ""
+	if unlinked != "" {
+		output = output + "Only in sitemap.xml, nothing links to them:\n" + unlinked
+	}
+	if linked != "" {
+		output = output + "Linked to from other pages:\n" + linked
+	}
+	return output
+}
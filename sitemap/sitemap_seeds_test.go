@@ -0,0 +1,216 @@
+package sitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kn100/charlotte/fetch"
+)
+
+/*
+sitemapSite serves a site whose robots.txt points at a gzipped sitemap index,
+as well as having a plain /sitemap.xml. Only /about is linked from the home
+page; /orphan and /hidden are only in the sitemaps.
+*/
+func sitemapSite(requests map[string]int, mu *sync.Mutex) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "User-agent: *\nDisallow:\nSitemap: %s/maps/index.xml\n", ts.URL)
+		case "/maps/index.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%s/maps/pages.xml.gz</loc></sitemap>
+</sitemapindex>`, ts.URL)
+		case "/maps/pages.xml.gz":
+			var compressed bytes.Buffer
+			writer := gzip.NewWriter(&compressed)
+			fmt.Fprintf(writer, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><url><loc>%s/hidden</loc></url></urlset>`, ts.URL)
+			writer.Close()
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Write(compressed.Bytes())
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/</loc></url>
+  <url><loc> %[1]s/about </loc></url>
+  <url><loc>%[1]s/orphan#top</loc></url>
+  <url><loc>https://monzo.com/</loc></url>
+</urlset>`, ts.URL)
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="/about">About</a>`)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<p>Nothing to see here</p>`)
+		}
+	}))
+	return ts
+}
+
+func TestCrawlerSitemapSeeds(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := sitemapSite(requests, &mu)
+	defer ts.Close()
+
+	sm, err := NewCrawler(WithDepth(2), WithSitemapSeeds(true)).Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	for _, path := range []string{"/", "/about", "/orphan", "/hidden"} {
+		if requests[path] != 1 {
+			t.Errorf("Expected %s to be fetched once, requests were %v", path, requests)
+		}
+	}
+	if len(sm.SitemapFiles) != 3 {
+		t.Errorf("Expected 3 sitemap files to be read, got %v", sm.SitemapFiles)
+	}
+
+	linked := make(map[string]bool)
+	for _, page := range sm.ListedPages() {
+		linked[strings.TrimPrefix(page.URL, ts.URL)] = page.Linked
+	}
+	expected := map[string]bool{"/": true, "/about": true, "/orphan": false, "/hidden": false}
+	if fmt.Sprint(linked) != fmt.Sprint(expected) {
+		t.Errorf("Expected listed pages %v, got %v", expected, linked)
+	}
+
+	report := sm.ListedPagesReport()
+	if !strings.Contains(report, "nothing links to them:\n  "+ts.URL+"/orphan\n  "+ts.URL+"/hidden\n") {
+		t.Errorf("Expected the report to list the orphans, got:\n%s", report)
+	}
+	tree := sm.String()
+	if !strings.Contains(tree, ts.URL+"/orphan [200") || !strings.Contains(tree, "(from sitemap.xml)") {
+		t.Errorf("Expected the orphans to show up in the tree, got:\n%s", tree)
+	}
+}
+
+func TestListedPagesLinkedOnlyByOrphans(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<urlset><url><loc>%[1]s/a</loc></url><url><loc>%[1]s/b</loc></url></urlset>`, ts.URL)
+		case "/a":
+			fmt.Fprint(w, `<a href="/b">B</a>`)
+		case "/b":
+			fmt.Fprint(w, `<a href="/a">A</a>`)
+		default:
+			fmt.Fprint(w, `<p>Nothing to see here</p>`)
+		}
+	}))
+	defer ts.Close()
+
+	sm, err := NewCrawler(WithDepth(3), WithIgnoreRobots(true), WithSitemapSeeds(true)).Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	pages := sm.ListedPages()
+	if len(pages) != 2 {
+		t.Fatalf("Expected 2 listed pages, got %v", pages)
+	}
+	for _, page := range pages {
+		if page.Linked {
+			t.Errorf("Expected %s to be unlinked, since only another orphan links to it", page.URL)
+		}
+	}
+}
+
+func TestCrawlerSitemapSeedsFetchedLikePages(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	var agents []string
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		attempt := requests[r.URL.Path]
+		agents = append(agents, r.UserAgent())
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "User-agent: *\nDisallow: /private/\nSitemap: %s/private/sitemap.xml\n", ts.URL)
+		case "/sitemap.xml":
+			if attempt == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintf(w, `<urlset><url><loc>%s/orphan</loc></url></urlset>`, ts.URL)
+		default:
+			fmt.Fprint(w, `<p>Nothing to see here</p>`)
+		}
+	}))
+	defer ts.Close()
+
+	sm, err := NewCrawler(WithDepth(2), WithSitemapSeeds(true), WithUserAgent("sitemapbot/1.0")).Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if requests["/private/sitemap.xml"] != 0 {
+		t.Errorf("Expected the sitemap robots.txt disallows not to be read")
+	}
+	if requests["/sitemap.xml"] != 2 || requests["/orphan"] != 1 {
+		t.Errorf("Expected /sitemap.xml to be retried and its page crawled, requests were %v", requests)
+	}
+	for _, agent := range agents {
+		if agent != "sitemapbot/1.0" {
+			t.Errorf("Expected every request to carry our User-Agent, got %q", agent)
+		}
+	}
+	if len(sm.Skipped) != 1 || sm.Skipped[0].URL != ts.URL+"/private/sitemap.xml" {
+		t.Errorf("Expected the disallowed sitemap to be skipped, got %+v", sm.Skipped)
+	}
+}
+
+func TestCrawlerSitemapSeedsOff(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := sitemapSite(requests, &mu)
+	defer ts.Close()
+
+	sm, err := NewCrawler(WithDepth(2), WithIgnoreRobots(true)).Crawl(context.Background(), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if requests["/sitemap.xml"] != 0 || requests["/orphan"] != 0 {
+		t.Errorf("Sitemaps shouldn't be read unless asked for, requests were %v", requests)
+	}
+	if report := sm.ListedPagesReport(); report != "No pages were listed in a sitemap.xml.\n" {
+		t.Errorf("Unexpected report: %q", report)
+	}
+}
+
+func TestReadSitemapRejectsOtherXML(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/feed.xml":
+			fmt.Fprint(w, `<rss><channel></channel></rss>`)
+		case "/broken.xml":
+			fmt.Fprint(w, `<urlset><url>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	for _, path := range []string{"/feed.xml", "/broken.xml", "/missing.xml"} {
+		link, _ := url.Parse(ts.URL + path)
+		if _, err := readSitemap(context.Background(), ts.Client(), link, fetch.DefaultOptions()); err == nil {
+			t.Errorf("Expected an error reading %s", path)
+		}
+	}
+}
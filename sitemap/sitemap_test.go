@@ -1,10 +1,17 @@
 package sitemap
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kn100/charlotte/fetch"
+	"github.com/kn100/charlotte/util"
 )
 
 func TestSiteMapString(t *testing.T) {
@@ -135,8 +142,247 @@ func TestGetNodesFromDepth1(t *testing.T) {
 	}
 }
 
-// TODO: Testing fillSiteMap and MakeSiteMap would require mocking, and I don't have time right now
-// to do this.
+/*
+testSite serves a tiny site for crawling:
+/ links to /about, /secret and /gone. /about links back to / and on to /deep.
+robots.txt disallows /secret, and /gone is a 404.
+*/
+func testSite() *httptest.Server {
+	pages := map[string]string{
+		"/":       `<a href="/about">About</a><a href="/secret">Secret</a><a href="/gone">Gone</a>`,
+		"/about":  `<a href="/">Home</a><a href="/deep">Deep</a>`,
+		"/deep":   `Nothing to see here`,
+		"/secret": `<a href="/secret/more">More</a>`,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fmt.Fprint(w, "User-agent: *\nDisallow: /secret\n")
+			return
+		}
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+}
+
+/*
+mustParseURL parses raw, which is a URL written into a test, so it panics if
+it doesn't parse.
+*/
+func mustParseURL(raw string) *url.URL {
+	link, err := url.Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	return link
+}
+
+/*
+links returns a fetch.Link for each URL, with no text.
+*/
+func links(raws ...string) []fetch.Link {
+	var found []fetch.Link
+	for _, raw := range raws {
+		found = append(found, fetch.Link{URL: mustParseURL(raw)})
+	}
+	return found
+}
+
+/*
+buildSiteMap fills in sm as if a crawl had fetched each of levels in turn,
+rooted at the first page of the first level.
+*/
+func buildSiteMap(sm *SiteMap, levels ...[]fetch.JobResult) *SiteMap {
+	sm.SetRootNode(levels[0][0].FromURL)
+	for _, level := range levels {
+		addToSiteMap(sm, level)
+	}
+	return sm
+}
+
+func TestMakeSiteMap(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	sm := MakeSiteMap(ts.URL+"/", 3, time.Second)
+	expected := []string{"/", "/about", "/secret", "/gone", "/deep"}
+	for _, path := range expected {
+		link, _ := url.Parse(ts.URL + path)
+		if _, ok := sm.Lookup(link); !ok {
+			t.Errorf("Expected %s to be in the sitemap", link)
+		}
+	}
+	secretMore, _ := url.Parse(ts.URL + "/secret/more")
+	if _, ok := sm.Lookup(secretMore); ok {
+		t.Errorf("/secret is disallowed, so /secret/more should never have been found")
+	}
+	if len(sm.Skipped) != 1 || sm.Skipped[0].URL != ts.URL+"/secret" {
+		t.Errorf("Expected /secret to be skipped, got %+v", sm.Skipped)
+	}
+	broken := sm.BrokenLinks()
+	if len(broken) != 1 || broken[0].URL != ts.URL+"/gone" || broken[0].StatusCode != 404 {
+		t.Errorf("Expected /gone to be the only broken link, got %+v", broken)
+	}
+	if sm.FinishedAt == 0 {
+		t.Errorf("Expected FinishedAt to be set")
+	}
+}
+
+func TestCrawlWithScope(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	baseURL, _ := url.Parse(ts.URL + "/")
+	excludeGone, _ := util.NewRegexScope(nil, []string{`/gone$`})
+	sm := SiteMap{Depth: 3, Scope: util.AllScopes{util.NewExactHostScope(baseURL), excludeGone}}
+	sm.SetRootNode(baseURL)
+	sm.Crawl(time.Second)
+	goneURL, _ := url.Parse(ts.URL + "/gone")
+	if _, ok := sm.Lookup(goneURL); ok {
+		t.Errorf("/gone is out of scope, so shouldn't be in the sitemap")
+	}
+	deepURL, _ := url.Parse(ts.URL + "/deep")
+	if _, ok := sm.Lookup(deepURL); !ok {
+		t.Errorf("Expected /deep to be in the sitemap")
+	}
+}
+
+func TestCrawlContextInterrupted(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `<a href="/slow">Slow</a><a href="/fast">Fast</a>`)
+			return
+		}
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		fmt.Fprint(w, `<a href="/fast/child">Child</a>`)
+	}))
+	defer ts.Close()
+
+	baseURL, _ := url.Parse(ts.URL + "/")
+	sm := SiteMap{Depth: 3, IgnoreRobots: true}
+	sm.SetRootNode(baseURL)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	sm.CrawlContext(ctx, 10*time.Second)
+
+	if !sm.Interrupted {
+		t.Errorf("Expected the crawl to be marked as interrupted")
+	}
+	if sm.FinishedAt == 0 {
+		t.Errorf("Expected FinishedAt to be set")
+	}
+	childURL, _ := url.Parse(ts.URL + "/fast/child")
+	if _, ok := sm.Lookup(childURL); !ok {
+		t.Errorf("Expected what was found before the interruption to be kept")
+	}
+	slowURL, _ := url.Parse(ts.URL + "/slow")
+	if node, _ := sm.Lookup(slowURL); node.FetchError != "" {
+		t.Errorf("An interrupted fetch shouldn't be recorded as a failure, got %s", node.FetchError)
+	}
+}
+
+func TestMakeSiteMapIgnoringRobots(t *testing.T) {
+	ts := testSite()
+	defer ts.Close()
+
+	baseURL, _ := url.Parse(ts.URL + "/")
+	sm := SiteMap{Depth: 2, IgnoreRobots: true}
+	sm.SetRootNode(baseURL)
+	sm.Crawl(time.Second)
+	secretMore, _ := url.Parse(ts.URL + "/secret/more")
+	if _, ok := sm.Lookup(secretMore); !ok {
+		t.Errorf("With robots.txt ignored, /secret/more should have been found")
+	}
+	if len(sm.Skipped) != 0 {
+		t.Errorf("Expected nothing to be skipped, got %+v", sm.Skipped)
+	}
+}
+
+func TestCrawlKeepsCrawlDelayAcrossLevels(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fmt.Fprint(w, "User-agent: *\nCrawl-delay: 0.1\n")
+			return
+		}
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/a">A</a>`)
+		case "/a":
+			fmt.Fprint(w, `<a href="/b">B</a>`)
+		}
+	}))
+	defer ts.Close()
+
+	baseURL, _ := url.Parse(ts.URL + "/")
+	sm := SiteMap{Depth: 3}
+	sm.SetRootNode(baseURL)
+	sm.Crawl(time.Second)
+	if len(times) != 3 {
+		t.Fatalf("Expected 3 pages to be fetched, got %d", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < 90*time.Millisecond {
+			t.Errorf("Expected level %d to wait out the Crawl-delay, only %s after the last", i, gap)
+		}
+	}
+}
+
+func TestCrawlFetchDefaults(t *testing.T) {
+	cases := []struct {
+		name    string
+		fetch   fetch.Options
+		retried bool
+		sniffed bool
+	}{
+		{"unset", fetch.Options{}, true, true},
+		{"partly set", fetch.Options{Concurrency: 2, UserAgent: "partbot/1.0"}, true, true},
+		{"no retries", fetch.Options{Concurrency: 2, NoRetries: true}, false, true},
+		{"no sniffing", fetch.Options{NoSniff: true}, true, false},
+	}
+	for _, c := range cases {
+		var mu sync.Mutex
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			fmt.Fprint(w, `<a href="/about">About</a>`)
+		}))
+
+		baseURL, _ := url.Parse(ts.URL + "/")
+		sm := SiteMap{Depth: 1, IgnoreRobots: true, Fetch: c.fetch}
+		sm.SetRootNode(baseURL)
+		sm.Crawl(time.Second)
+		ts.Close()
+		retried := sm.RootNode.StatusCode == 200 && sm.RootNode.FetchError == ""
+		if retried != c.retried {
+			t.Errorf("%s: expected retried to be %t, got %d (%s)", c.name, c.retried, sm.RootNode.StatusCode, sm.RootNode.FetchError)
+		}
+		if sniffed := len(sm.RootNode.LinksTo) == 1; c.retried && sniffed != c.sniffed {
+			t.Errorf("%s: expected sniffed to be %t, got links %v", c.name, c.sniffed, sm.RootNode.LinksTo)
+		}
+	}
+}
 
 func TestGetURLsFromNodeSlice(t *testing.T) {
 	URL0, _ := url.Parse("https://kn100.me/")
@@ -154,15 +400,15 @@ func TestGetURLsFromNodeSlice(t *testing.T) {
 	}
 }
 
-func TestaddToSiteMap(t *testing.T) {
+func TestAddToSiteMap(t *testing.T) {
 	sm := SiteMap{RootNode: nil, Depth: 2, CreatedAt: 31989300, FinishedAt: 31989300}
 	baseURL, _ := url.Parse("https://kn100.me/")
 	sm.SetRootNode(baseURL)
 
 	leafURL, _ := url.Parse("https://kn100.me/leaf/")
 	leafURL2, _ := url.Parse("https://kn100.me/otherleaf/")
-	var leafs []*url.URL
-	leafs = append(leafs, leafURL, leafURL2)
+	var leafs []fetch.Link
+	leafs = append(leafs, fetch.Link{URL: leafURL}, fetch.Link{URL: leafURL2})
 
 	jobResult := fetch.JobResult{FromURL: baseURL, LinksTo: leafs}
 	var jobResults []fetch.JobResult
@@ -172,7 +418,92 @@ func TestaddToSiteMap(t *testing.T) {
 	if sm.RootNode.LinksTo[0].URL != leafURL {
 		t.Errorf("Expected the first node the root node linked to be %s, actual: %s", leafURL, sm.RootNode.LinksTo[0].URL)
 	}
-	if sm.RootNode.LinksTo[1].URL != leafURL {
+	if sm.RootNode.LinksTo[1].URL != leafURL2 {
 		t.Errorf("Expected the second node the root node linked to be %s, actual: %s", leafURL2, sm.RootNode.LinksTo[1].URL)
 	}
 }
+
+func TestAddToSiteMapRecordsResponse(t *testing.T) {
+	sm := SiteMap{Depth: 1}
+	baseURL, _ := url.Parse("https://kn100.me/")
+	finalURL, _ := url.Parse("https://www.kn100.me/")
+	sm.SetRootNode(baseURL)
+
+	jobResult := fetch.JobResult{
+		FromURL:       baseURL,
+		StatusCode:    200,
+		FinalURL:      finalURL,
+		ContentType:   "text/html",
+		ContentLength: 1024,
+		ResponseTime:  time.Second,
+	}
+	addToSiteMap(&sm, []fetch.JobResult{jobResult})
+	root := sm.RootNode
+	if root.StatusCode != 200 || root.ContentType != "text/html" || root.ContentLength != 1024 || root.ResponseTime != time.Second {
+		t.Errorf("Response metadata wasn't recorded on the root node: %+v", root)
+	}
+	if root.FinalURL != finalURL.String() {
+		t.Errorf("Expected the final URL to be %s, got %s", finalURL, root.FinalURL)
+	}
+	if root.FetchError != "" {
+		t.Errorf("Expected no fetch error, got %s", root.FetchError)
+	}
+}
+
+func TestSiteMapsDoNotShareURLs(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	leafURL, _ := url.Parse("https://kn100.me/leaf")
+	sm1 := SiteMap{Depth: 1}
+	sm2 := SiteMap{Depth: 1}
+	sm1.SetRootNode(baseURL)
+	sm2.SetRootNode(baseURL)
+	sm1.AddLeaf(baseURL, leafURL)
+	added, err := sm2.AddLeaf(baseURL, leafURL)
+	if err != nil || added != true {
+		t.Errorf("A URL seen by one Sitemap should still be new to another. Err: %s", err)
+	}
+}
+
+func TestAddLeafConcurrently(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	sm := SiteMap{Depth: 1}
+	sm.SetRootNode(baseURL)
+
+	// Every URL is added twice, from different goroutines. Only one of each
+	// pair should win.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := 0
+	for i := 0; i < 100; i++ {
+		leafURL, _ := url.Parse(fmt.Sprintf("https://kn100.me/leaf/%d", i%50))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, _ := sm.AddLeaf(baseURL, leafURL)
+			if ok {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 50 || len(sm.RootNode.LinksTo) != 50 {
+		t.Errorf("Expected 50 unique leaves, added %d and the root has %d", added, len(sm.RootNode.LinksTo))
+	}
+}
+
+func TestLookup(t *testing.T) {
+	baseURL, _ := url.Parse("https://kn100.me/")
+	leafURL, _ := url.Parse("https://kn100.me/leaf")
+	otherURL, _ := url.Parse("https://kn100.me/other")
+	sm := SiteMap{Depth: 1}
+	sm.SetRootNode(baseURL)
+	sm.AddLeaf(baseURL, leafURL)
+	if node, ok := sm.Lookup(leafURL); !ok || node.URL != leafURL {
+		t.Errorf("Expected to find %s", leafURL)
+	}
+	if _, ok := sm.Lookup(otherURL); ok {
+		t.Errorf("Did not expect to find %s", otherURL)
+	}
+}
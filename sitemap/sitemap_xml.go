@@ -0,0 +1,270 @@
+package sitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The limits on a single sitemap.xml file from the sitemaps.org protocol. Past
+either of them, the URLs have to be split over several files with a sitemap
+index pointing at them. The size is before any gzipping.
+*/
+const (
+	MaxXMLURLs  int = 50000
+	MaxXMLBytes int = 50 << 20
+)
+
+/*
+xmlNamespace is the namespace every sitemap and sitemap index has to be in.
+*/
+const xmlNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+/*
+XMLOptions controls how a SiteMap is written out as sitemap.xml.
+BaseURL is where the files are going to be served from, which a sitemap index
+needs to point at the rest of them, and only pages on its scheme and host are
+listed. It defaults to the root of the site.
+Name is the file name to use, without the extension, and defaults to
+"sitemap". If the URLs have to be split, the index is Name.xml and the files
+it points at are Name-1.xml, Name-2.xml and so on.
+Priority adds a <priority> to every URL, from 1.0 for the seed down by 0.2 for
+each link further away it is, to a minimum of 0.1. Gzip compresses every file,
+and adds .gz to their names.
+MaxURLs and MaxBytes are how big a file can get before the URLs are split, and
+fall back to MaxXMLURLs and MaxXMLBytes if they aren't set. Search engines
+won't accept anything bigger than those.
+*/
+type XMLOptions struct {
+	BaseURL  string
+	Name     string
+	Priority bool
+	Gzip     bool
+	MaxURLs  int
+	MaxBytes int
+}
+
+/*
+XMLFile is one file of an XML sitemap, ready to be written out.
+*/
+type XMLFile struct {
+	Name string
+	Data []byte
+}
+
+/*
+xmlURL is one <url> in a sitemap.
+*/
+type xmlURL struct {
+	XMLName  xml.Name `xml:"url"`
+	Loc      string   `xml:"loc"`
+	LastMod  string   `xml:"lastmod,omitempty"`
+	Priority string   `xml:"priority,omitempty"`
+}
+
+/*
+xmlSitemap is one <sitemap> in a sitemap index.
+*/
+type xmlSitemap struct {
+	XMLName xml.Name `xml:"sitemap"`
+	Loc     string   `xml:"loc"`
+	LastMod string   `xml:"lastmod,omitempty"`
+}
+
+/*
+withDefaults returns a copy of o with anything that isn't set filled in.
+*/
+func (o XMLOptions) withDefaults(s *SiteMap) XMLOptions {
+	if o.Name == "" {
+		o.Name = "sitemap"
+	}
+	if o.MaxURLs < 1 {
+		o.MaxURLs = MaxXMLURLs
+	}
+	if o.MaxBytes < 1 {
+		o.MaxBytes = MaxXMLBytes
+	}
+	if o.BaseURL == "" && s.RootNode != nil {
+		root := url.URL{Scheme: s.RootNode.URL.Scheme, Host: s.RootNode.URL.Host, Path: "/"}
+		o.BaseURL = root.String()
+	}
+	return o
+}
+
+/*
+XMLSitemaps returns the Sitemap in the sitemaps.org XML format that search
+engines read. It's normally a single file, but if there are too many URLs for
+one, the first file is a sitemap index pointing at the rest. Either way, the
+first file is the one to submit.
+Only pages that were fetched and came back with a 2xx are included, at the URL
+we ended up at after any redirects. Search engines ignore URLs on any other
+host than the sitemap's, so pages whose scheme and host aren't BaseURL's are
+left out too, subdomains included. <lastmod> comes from the page's
+Last-Modified header.
+*/
+func (s *SiteMap) XMLSitemaps(opts XMLOptions) ([]XMLFile, error) {
+	opts = opts.withDefaults(s)
+	base, err := url.Parse(opts.BaseURL)
+	if err != nil || (opts.BaseURL != "" && !base.IsAbs()) {
+		return nil, fmt.Errorf("the base URL has to be absolute, not %q", opts.BaseURL)
+	}
+	entries, err := s.xmlEntries(base, opts.Priority)
+	if err != nil {
+		return nil, err
+	}
+
+	header := xml.Header + `<urlset xmlns="` + xmlNamespace + `">` + "\n"
+	footer := "</urlset>\n"
+	var parts [][]byte
+	part := bytes.NewBufferString(header)
+	count := 0
+	for _, entry := range entries {
+		if len(header)+len(entry)+len(footer) > opts.MaxBytes {
+			return nil, fmt.Errorf("the entry for a URL is %d bytes, which is too big to fit in a %d byte sitemap", len(entry), opts.MaxBytes)
+		}
+		if count == opts.MaxURLs || part.Len()+len(entry)+len(footer) > opts.MaxBytes {
+			part.WriteString(footer)
+			parts = append(parts, part.Bytes())
+			part = bytes.NewBufferString(header)
+			count = 0
+		}
+		part.Write(entry)
+		count++
+	}
+	part.WriteString(footer)
+	parts = append(parts, part.Bytes())
+
+	extension := ".xml"
+	if opts.Gzip {
+		extension = ".xml.gz"
+	}
+	if len(parts) == 1 {
+		file, err := xmlFile(opts.Name+extension, parts[0], opts.Gzip)
+		if err != nil {
+			return nil, err
+		}
+		return []XMLFile{file}, nil
+	}
+
+	lastMod := ""
+	if s.FinishedAt != 0 {
+		lastMod = time.Unix(s.FinishedAt, 0).UTC().Format(time.RFC3339)
+	}
+	files := []XMLFile{{}}
+	index := bytes.NewBufferString(xml.Header + `<sitemapindex xmlns="` + xmlNamespace + `">` + "\n")
+	for i, data := range parts {
+		name := fmt.Sprintf("%s-%d%s", opts.Name, i+1, extension)
+		file, err := xmlFile(name, data, opts.Gzip)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+		entry, err := xml.MarshalIndent(xmlSitemap{Loc: base.JoinPath(name).String(), LastMod: lastMod}, "  ", "  ")
+		if err != nil {
+			return nil, err
+		}
+		index.Write(entry)
+		index.WriteString("\n")
+	}
+	index.WriteString("</sitemapindex>\n")
+	files[0], err = xmlFile(opts.Name+extension, index.Bytes(), opts.Gzip)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+/*
+XML returns the Sitemap as a single sitemap.xml, for when you know it's small
+enough to fit in one. It returns an error if it isn't.
+*/
+func (s *SiteMap) XML(priority bool) (string, error) {
+	files, err := s.XMLSitemaps(XMLOptions{Priority: priority})
+	if err != nil {
+		return "", err
+	}
+	if len(files) > 1 {
+		return "", errors.New("the sitemap is too big for one file, use XMLSitemaps instead")
+	}
+	return string(files[0].Data), nil
+}
+
+/*
+xmlEntries returns the <url> for every page that belongs in the sitemap, in
+the order they appear in the tree, one per line. Only pages on base's scheme
+and host belong.
+*/
+func (s *SiteMap) xmlEntries(base *url.URL, priority bool) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries [][]byte
+	if s.RootNode == nil {
+		return entries, nil
+	}
+	seen := make(map[string]bool)
+	var err error
+	s.RootNode.walkDepth(0, func(node *Node, depth int) {
+		if err != nil || node.StatusCode < 200 || node.StatusCode >= 300 || node.FetchError != "" {
+			return
+		}
+		entry := xmlURL{Loc: node.URL.String()}
+		if node.FinalURL != "" {
+			entry.Loc = node.FinalURL
+		}
+		if node.LastModified != 0 {
+			entry.LastMod = time.Unix(node.LastModified, 0).UTC().Format(time.RFC3339)
+		}
+		if priority {
+			entry.Priority = depthPriority(depth)
+		}
+		loc, parseErr := url.Parse(entry.Loc)
+		if parseErr != nil || !strings.EqualFold(loc.Scheme, base.Scheme) || !strings.EqualFold(loc.Host, base.Host) {
+			return
+		}
+		if seen[entry.Loc] {
+			return
+		}
+		seen[entry.Loc] = true
+		var line []byte
+		line, err = xml.MarshalIndent(entry, "  ", "  ")
+		entries = append(entries, append(line, '\n'))
+	})
+	return entries, err
+}
+
+/*
+depthPriority returns the <priority> for a page depth links away from the
+seed.
+*/
+func depthPriority(depth int) string {
+	priority := 1.0 - 0.2*float64(depth)
+	if priority < 0.1 {
+		priority = 0.1
+	}
+	return strconv.FormatFloat(priority, 'f', 1, 64)
+}
+
+/*
+xmlFile makes an XMLFile, gzipping data first if asked to.
+*/
+func xmlFile(name string, data []byte, compress bool) (XMLFile, error) {
+	if !compress {
+		return XMLFile{Name: name, Data: data}, nil
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return XMLFile{}, err
+	}
+	if err := writer.Close(); err != nil {
+		return XMLFile{}, err
+	}
+	return XMLFile{Name: name, Data: compressed.Bytes()}, nil
+}
@@ -0,0 +1,176 @@
+package sitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kn100/charlotte/fetch"
+)
+
+/*
+xmlSiteMap builds a sitemap with a home page, two pages under it, a page that
+redirects, and one that's missing.
+*/
+func xmlSiteMap() *SiteMap {
+	return buildSiteMap(&SiteMap{Depth: 3, FinishedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()},
+		[]fetch.JobResult{{
+			FromURL:      mustParseURL("https://kn100.me/"),
+			StatusCode:   200,
+			LastModified: time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC),
+			LinksTo:      links("https://kn100.me/about?a=1&b=2", "https://kn100.me/old", "https://kn100.me/gone"),
+		}},
+		[]fetch.JobResult{
+			{FromURL: mustParseURL("https://kn100.me/about?a=1&b=2"), StatusCode: 200},
+			{FromURL: mustParseURL("https://kn100.me/old"), FinalURL: mustParseURL("https://kn100.me/new"), StatusCode: 200},
+			{FromURL: mustParseURL("https://kn100.me/gone"), StatusCode: 404},
+		},
+	)
+}
+
+func TestXML(t *testing.T) {
+	sm := xmlSiteMap()
+	output, err := sm.XML(true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url>
+    <loc>https://kn100.me/</loc>
+    <lastmod>2023-05-06T07:08:09Z</lastmod>
+    <priority>1.0</priority>
+  </url>
+  <url>
+    <loc>https://kn100.me/about?a=1&amp;b=2</loc>
+    <priority>0.8</priority>
+  </url>
+  <url>
+    <loc>https://kn100.me/new</loc>
+    <priority>0.8</priority>
+  </url>
+</urlset>
+`
+	if output != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, output)
+	}
+
+	var parsed struct {
+		URLs []xmlURL `xml:"url"`
+	}
+	if err := xml.Unmarshal([]byte(output), &parsed); err != nil || len(parsed.URLs) != 3 {
+		t.Errorf("Expected the output to parse back into 3 URLs, got %v (err: %v)", parsed.URLs, err)
+	}
+}
+
+func TestXMLSitemapsSplits(t *testing.T) {
+	sm := xmlSiteMap()
+	files, err := sm.XMLSitemaps(XMLOptions{MaxURLs: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected an index and 2 sitemaps, got %d files", len(files))
+	}
+	names := []string{files[0].Name, files[1].Name, files[2].Name}
+	if fmt.Sprint(names) != "[sitemap.xml sitemap-1.xml sitemap-2.xml]" {
+		t.Errorf("Unexpected file names %v", names)
+	}
+	index := string(files[0].Data)
+	for _, expected := range []string{"<sitemapindex", "<loc>https://kn100.me/sitemap-1.xml</loc>", "<loc>https://kn100.me/sitemap-2.xml</loc>", "<lastmod>2024-01-02T03:04:05Z</lastmod>"} {
+		if !strings.Contains(index, expected) {
+			t.Errorf("Expected the index to contain %s, got:\n%s", expected, index)
+		}
+	}
+	if strings.Count(string(files[1].Data), "<url>") != 2 || strings.Count(string(files[2].Data), "<url>") != 1 {
+		t.Errorf("Expected the URLs to be split 2 and 1, got:\n%s\n%s", files[1].Data, files[2].Data)
+	}
+
+	bySize, err := sm.XMLSitemaps(XMLOptions{MaxBytes: 215, BaseURL: "https://kn100.me/maps/"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(bySize) != 4 {
+		t.Errorf("Expected each URL to need its own file, got %d files", len(bySize))
+	}
+	for _, file := range bySize[1:] {
+		if len(file.Data) > 215 {
+			t.Errorf("%s is %d bytes, over the limit", file.Name, len(file.Data))
+		}
+	}
+	if !strings.Contains(string(bySize[0].Data), "https://kn100.me/maps/sitemap-1.xml") {
+		t.Errorf("Expected the index to use the base URL, got:\n%s", bySize[0].Data)
+	}
+
+	if _, err := sm.XMLSitemaps(XMLOptions{MaxBytes: 100}); err == nil {
+		t.Errorf("Expected an error when a single URL can't fit in a file")
+	}
+	if _, err := sm.XML(false); err != nil {
+		t.Errorf("Expected the whole sitemap to fit in one file by default, got %s", err)
+	}
+}
+
+func TestXMLOnlyListsPagesOnTheBaseHost(t *testing.T) {
+	sm := xmlSiteMap()
+	baseURL, _ := url.Parse("https://kn100.me/")
+	blogURL, _ := url.Parse("https://blog.kn100.me/")
+	awayURL, _ := url.Parse("https://kn100.me/away")
+	elsewhereURL, _ := url.Parse("https://elsewhere.example/")
+	sm.AddLeaf(baseURL, blogURL)
+	sm.AddLeaf(baseURL, awayURL)
+	addToSiteMap(sm, []fetch.JobResult{
+		{FromURL: blogURL, StatusCode: 200},
+		{FromURL: awayURL, FinalURL: elsewhereURL, StatusCode: 200},
+	})
+
+	output, err := sm.XML(false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if strings.Count(output, "<url>") != 3 || strings.Contains(output, "blog.kn100.me") || strings.Contains(output, "elsewhere.example") {
+		t.Errorf("Expected only the 3 pages on kn100.me, got:\n%s", output)
+	}
+	files, err := sm.XMLSitemaps(XMLOptions{BaseURL: "http://kn100.me/"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if strings.Contains(string(files[0].Data), "<url>") {
+		t.Errorf("Expected no https pages in an http sitemap, got:\n%s", files[0].Data)
+	}
+	if _, err := sm.XMLSitemaps(XMLOptions{BaseURL: "/maps/"}); err == nil {
+		t.Errorf("Expected an error for a base URL that isn't absolute")
+	}
+}
+
+func TestXMLSitemapsGzip(t *testing.T) {
+	sm := xmlSiteMap()
+	files, err := sm.XMLSitemaps(XMLOptions{Gzip: true, Name: "pages"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(files) != 1 || files[0].Name != "pages.xml.gz" {
+		t.Fatalf("Expected a single pages.xml.gz, got %v", files)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(files[0].Data))
+	if err != nil {
+		t.Fatalf("Expected gzipped data, got %s", err)
+	}
+	data, _ := io.ReadAll(reader)
+	if !strings.Contains(string(data), "<loc>https://kn100.me/new</loc>") {
+		t.Errorf("Unexpected contents once unzipped:\n%s", data)
+	}
+}
+
+func TestDepthPriority(t *testing.T) {
+	for depth, expected := range []string{"1.0", "0.8", "0.6", "0.4", "0.2", "0.1", "0.1"} {
+		if got := depthPriority(depth); got != expected {
+			t.Errorf("depthPriority(%d) should have been %s, got %s", depth, expected, got)
+		}
+	}
+}
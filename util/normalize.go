@@ -0,0 +1,376 @@
+package util
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+TrailingSlash says what a Normalizer does with a slash on the end of a path.
+*/
+type TrailingSlash int
+
+const (
+	// KeepTrailingSlash leaves paths alone, since /about and /about/ can be
+	// different pages.
+	KeepTrailingSlash TrailingSlash = iota
+	// AddTrailingSlash turns /about into /about/. Paths that look like files
+	// (/cv.pdf) are left alone.
+	AddTrailingSlash
+	// RemoveTrailingSlash turns /about/ into /about. The root stays as /.
+	RemoveTrailingSlash
+)
+
+/*
+SchemePolicy says whether http and https versions of a URL are the same page.
+*/
+type SchemePolicy int
+
+const (
+	// KeepSchemes treats http://kn100.me/x and https://kn100.me/x as two
+	// different pages, and crawls both.
+	KeepSchemes SchemePolicy = iota
+	// MergeSchemes treats them as the same page, and crawls whichever one
+	// was found first.
+	MergeSchemes
+	// PreferHTTPS treats them as the same page, and always crawls it over
+	// https.
+	PreferHTTPS
+)
+
+/*
+DefaultTrackingParams are the query parameters that only say how someone got
+to a page, not which page it is. A trailing * matches any parameter starting
+with what comes before it.
+*/
+var DefaultTrackingParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "_ga"}
+
+/*
+DefaultIndexFiles are the file names that usually mean the same thing as the
+directory they are in.
+*/
+var DefaultIndexFiles = []string{"index.html", "index.htm"}
+
+/*
+Normalizer turns the many ways of writing a URL into one, so the same page
+isn't crawled twice. Every rule can be turned on or off by itself, and they
+are applied in the order they're listed here:
+
+LowercaseSchemeAndHost turns HTTP://KN100.me into http://kn100.me.
+RemoveDefaultPort drops :80 from http URLs and :443 from https ones.
+EmptyPathAsSlash turns http://kn100.me into http://kn100.me/.
+NormalizePercentEncoding decodes escapes that didn't need to be escaped
+(%7E is ~) and uppercases the rest (%2f is %2F).
+ResolveDotSegments turns /a/./b/../c into /a/c.
+IndexFiles are file names that get dropped from the end of a path, so
+/docs/index.html becomes /docs/.
+TrailingSlash says whether to add or remove slashes on the end of paths.
+StripQuery drops the whole query string, which is how Charlotte used to work.
+StripParams are query parameters that get dropped, like DefaultTrackingParams.
+SortQuery puts the query parameters in order, so ?b=2&a=1 is ?a=1&b=2.
+StripFragment drops the #fragment, which never reaches the server anyway.
+
+Schemes is different: it's used by Key and Preferred, not Normalize, so links
+keep the scheme they were written with and it's still possible to tell which
+pages were linked to over plain http. Only URLs without an explicit port are
+merged, since http://kn100.me:8080 and https://kn100.me:8080 can't both work.
+*/
+type Normalizer struct {
+	LowercaseSchemeAndHost   bool
+	RemoveDefaultPort        bool
+	EmptyPathAsSlash         bool
+	NormalizePercentEncoding bool
+	ResolveDotSegments       bool
+	IndexFiles               []string
+	TrailingSlash            TrailingSlash
+	StripQuery               bool
+	StripParams              []string
+	SortQuery                bool
+	StripFragment            bool
+	Schemes                  SchemePolicy
+}
+
+/*
+DefaultNormalizer returns the Normalizer used when nobody says otherwise.
+It only does things that can't turn one page into another: it keeps the query
+string (minus tracking parameters), and leaves trailing slashes and index
+files alone.
+*/
+func DefaultNormalizer() Normalizer {
+	return Normalizer{
+		LowercaseSchemeAndHost:   true,
+		RemoveDefaultPort:        true,
+		EmptyPathAsSlash:         true,
+		NormalizePercentEncoding: true,
+		ResolveDotSegments:       true,
+		StripParams:              DefaultTrackingParams,
+		SortQuery:                true,
+		StripFragment:            true,
+		Schemes:                  MergeSchemes,
+	}
+}
+
+/*
+Normalize applies the rules to link, changing it in place like CleanURL does.
+*/
+func (n Normalizer) Normalize(link *url.URL) {
+	if n.LowercaseSchemeAndHost {
+		link.Scheme = strings.ToLower(link.Scheme)
+		link.Host = strings.ToLower(link.Host)
+	}
+	if n.RemoveDefaultPort {
+		port := link.Port()
+		if (port == "80" && strings.EqualFold(link.Scheme, "http")) || (port == "443" && strings.EqualFold(link.Scheme, "https")) {
+			link.Host = strings.TrimSuffix(link.Host, ":"+port)
+		}
+	}
+	if n.EmptyPathAsSlash && link.Host != "" && link.Path == "" && link.Opaque == "" {
+		link.Path = "/"
+		link.RawPath = ""
+	}
+	escapedPath := link.EscapedPath()
+	if n.NormalizePercentEncoding {
+		escapedPath = normalizePercentEncoding(escapedPath)
+		link.RawQuery = normalizePercentEncoding(link.RawQuery)
+	}
+	if n.ResolveDotSegments {
+		escapedPath = removeDotSegments(escapedPath)
+	}
+	if len(n.IndexFiles) > 0 {
+		dir, file := path.Split(escapedPath)
+		for _, index := range n.IndexFiles {
+			if dir != "" && strings.EqualFold(file, index) {
+				escapedPath = dir
+				break
+			}
+		}
+	}
+	escapedPath = n.TrailingSlash.apply(escapedPath)
+	setEscapedPath(link, escapedPath)
+
+	if n.StripQuery {
+		link.RawQuery = ""
+		link.ForceQuery = false
+	} else if len(n.StripParams) > 0 || n.SortQuery {
+		link.RawQuery = n.cleanQuery(link.RawQuery)
+	}
+	if n.StripFragment {
+		link.Fragment = ""
+		link.RawFragment = ""
+	}
+}
+
+/*
+Key returns the string that identifies the page link points at. Two
+normalized URLs with the same Key are the same page.
+*/
+func (n Normalizer) Key(link *url.URL) string {
+	if n.Schemes == KeepSchemes || !mergeableScheme(link) {
+		return link.String()
+	}
+	secure := *link
+	secure.Scheme = "https"
+	return secure.String()
+}
+
+/*
+Preferred returns the URL that should actually be fetched for link, which is
+the https version of it under PreferHTTPS and link itself otherwise. It never
+changes link.
+*/
+func (n Normalizer) Preferred(link *url.URL) *url.URL {
+	if n.Schemes != PreferHTTPS || !mergeableScheme(link) || link.Scheme == "https" {
+		return link
+	}
+	secure := *link
+	secure.Scheme = "https"
+	return &secure
+}
+
+/*
+mergeableScheme returns whether link is an http or https URL on its default
+port, so could be either.
+*/
+func mergeableScheme(link *url.URL) bool {
+	return (link.Scheme == "http" || link.Scheme == "https") && link.Port() == ""
+}
+
+/*
+apply returns p with the trailing slash policy applied.
+*/
+func (t TrailingSlash) apply(p string) string {
+	switch t {
+	case AddTrailingSlash:
+		if p != "" && !strings.HasSuffix(p, "/") && path.Ext(p) == "" {
+			return p + "/"
+		}
+	case RemoveTrailingSlash:
+		if len(p) > 1 && strings.HasSuffix(p, "/") {
+			return strings.TrimSuffix(p, "/")
+		}
+	}
+	return p
+}
+
+/*
+cleanQuery drops the parameters in n.StripParams from a raw query string, and
+sorts what's left if n.SortQuery is set. It works on the raw string, so
+anything it keeps is left exactly as it was written.
+*/
+func (n Normalizer) cleanQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	type param struct {
+		key string
+		raw string
+	}
+	var params []param
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+		key := raw
+		if equals := strings.IndexByte(raw, '='); equals >= 0 {
+			key = raw[:equals]
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if matchesParam(key, n.StripParams) {
+			continue
+		}
+		params = append(params, param{key: key, raw: raw})
+	}
+	if n.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return params[i].key < params[j].key
+		})
+	}
+	kept := make([]string, len(params))
+	for i, p := range params {
+		kept[i] = p.raw
+	}
+	return strings.Join(kept, "&")
+}
+
+/*
+matchesParam returns whether key is one of patterns. A pattern ending in *
+matches any key starting with the rest of it.
+*/
+func matchesParam(key string, patterns []string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+removeDotSegments is the algorithm from RFC 3986 section 5.2.4, which takes
+the . and .. segments out of a path.
+*/
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	var out []string
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			// The first segment of an absolute path is the empty string
+			// before its leading slash, and we can't go above that.
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+/*
+isUnreserved returns whether c is a character that never needs escaping in a
+URL.
+*/
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+/*
+normalizePercentEncoding decodes escaped characters that didn't need to be
+escaped, and uppercases the hex digits of the rest.
+*/
+func normalizePercentEncoding(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+/*
+setEscapedPath sets link's path from its escaped form, keeping the escaping
+as it is so things like %2F don't turn into real slashes.
+*/
+func setEscapedPath(link *url.URL, escapedPath string) {
+	if escapedPath == link.EscapedPath() {
+		return
+	}
+	unescaped, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return
+	}
+	link.Path = unescaped
+	link.RawPath = escapedPath
+}
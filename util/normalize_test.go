@@ -0,0 +1,117 @@
+package util
+
+import (
+	"net/url"
+	"testing"
+)
+
+/*
+checkNormalize asserts what n turns each of a list of URLs into.
+*/
+func checkNormalize(t *testing.T, n Normalizer, cases map[string]string) {
+	for raw, expected := range cases {
+		link, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("Couldn't parse %s: %s", raw, err)
+		}
+		n.Normalize(link)
+		if link.String() != expected {
+			t.Errorf("Normalize(%s) should have been %s, was %s", raw, expected, link.String())
+		}
+	}
+}
+
+func TestDefaultNormalizer(t *testing.T) {
+	checkNormalize(t, DefaultNormalizer(), map[string]string{
+		"HTTP://KN100.me":                          "http://kn100.me/",
+		"http://kn100.me:80/about":                 "http://kn100.me/about",
+		"https://kn100.me:443/about":               "https://kn100.me/about",
+		"https://kn100.me:80/about":                "https://kn100.me:80/about",
+		"https://kn100.me/%7Ekevin/a%2fb":          "https://kn100.me/~kevin/a%2Fb",
+		"https://kn100.me/a/./b/../c":              "https://kn100.me/a/c",
+		"https://kn100.me/../../a":                 "https://kn100.me/a",
+		"https://kn100.me/a/b/..":                  "https://kn100.me/a/",
+		"https://kn100.me/p?b=2&a=1":               "https://kn100.me/p?a=1&b=2",
+		"https://kn100.me/p?utm_source=x&id=3":     "https://kn100.me/p?id=3",
+		"https://kn100.me/p?fbclid=1&gclid=2":      "https://kn100.me/p",
+		"https://kn100.me/p?id=3#section":          "https://kn100.me/p?id=3",
+		"https://kn100.me/about/":                  "https://kn100.me/about/",
+		"https://kn100.me/docs/index.html":         "https://kn100.me/docs/index.html",
+		"https://kn100.me/p?q=a%20b&UTM_MEDIUM=em": "https://kn100.me/p?q=a%20b",
+	})
+}
+
+func TestNormalizerRulesCanBeTurnedOff(t *testing.T) {
+	checkNormalize(t, Normalizer{}, map[string]string{
+		"HTTP://KN100.me:80/a/./b?b=2&a=1&utm_source=x#top": "http://KN100.me:80/a/./b?b=2&a=1&utm_source=x#top",
+		"https://kn100.me/%7Ekevin":                         "https://kn100.me/%7Ekevin",
+	})
+}
+
+func TestNormalizerTrailingSlash(t *testing.T) {
+	checkNormalize(t, Normalizer{TrailingSlash: AddTrailingSlash}, map[string]string{
+		"https://kn100.me/about":  "https://kn100.me/about/",
+		"https://kn100.me/about/": "https://kn100.me/about/",
+		"https://kn100.me/cv.pdf": "https://kn100.me/cv.pdf",
+	})
+	checkNormalize(t, Normalizer{TrailingSlash: RemoveTrailingSlash}, map[string]string{
+		"https://kn100.me/about/": "https://kn100.me/about",
+		"https://kn100.me/about":  "https://kn100.me/about",
+		"https://kn100.me/":       "https://kn100.me/",
+	})
+}
+
+func TestNormalizerIndexFiles(t *testing.T) {
+	checkNormalize(t, Normalizer{IndexFiles: DefaultIndexFiles}, map[string]string{
+		"https://kn100.me/docs/index.html": "https://kn100.me/docs/",
+		"https://kn100.me/INDEX.HTM":       "https://kn100.me/",
+		"https://kn100.me/docs/main.html":  "https://kn100.me/docs/main.html",
+	})
+}
+
+func TestNormalizerQuery(t *testing.T) {
+	checkNormalize(t, Normalizer{StripQuery: true}, map[string]string{
+		"https://kn100.me/p?id=3": "https://kn100.me/p",
+		"https://kn100.me/p?":     "https://kn100.me/p",
+	})
+	checkNormalize(t, Normalizer{StripParams: []string{"session", "ref_*"}}, map[string]string{
+		"https://kn100.me/p?session=1&b=2&ref_src=x&a=1": "https://kn100.me/p?b=2&a=1",
+		"https://kn100.me/p?sessions=1":                  "https://kn100.me/p?sessions=1",
+	})
+	checkNormalize(t, Normalizer{SortQuery: true}, map[string]string{
+		"https://kn100.me/p?b=2&a=1&a=0": "https://kn100.me/p?a=1&a=0&b=2",
+	})
+}
+
+func TestNormalizerSchemes(t *testing.T) {
+	insecure, _ := url.Parse("http://kn100.me/about")
+	secure, _ := url.Parse("https://kn100.me/about")
+	withPort, _ := url.Parse("http://kn100.me:8080/about")
+
+	keep := Normalizer{Schemes: KeepSchemes}
+	if keep.Key(insecure) == keep.Key(secure) {
+		t.Errorf("KeepSchemes should keep http and https apart")
+	}
+	for _, policy := range []SchemePolicy{MergeSchemes, PreferHTTPS} {
+		n := Normalizer{Schemes: policy}
+		if n.Key(insecure) != n.Key(secure) {
+			t.Errorf("Policy %d should have merged http and https, got %s and %s", policy, n.Key(insecure), n.Key(secure))
+		}
+		if n.Key(withPort) != withPort.String() {
+			t.Errorf("Policy %d shouldn't have touched a URL with a port, got %s", policy, n.Key(withPort))
+		}
+	}
+
+	if got := (Normalizer{Schemes: PreferHTTPS}).Preferred(insecure); got.String() != secure.String() {
+		t.Errorf("PreferHTTPS should have preferred %s, got %s", secure, got)
+	}
+	if insecure.Scheme != "http" {
+		t.Errorf("Preferred shouldn't change the URL it's given")
+	}
+	if got := (Normalizer{Schemes: MergeSchemes}).Preferred(insecure); got != insecure {
+		t.Errorf("MergeSchemes should fetch whichever URL it was given, got %s", got)
+	}
+	if got := (Normalizer{Schemes: PreferHTTPS}).Preferred(withPort); got != withPort {
+		t.Errorf("PreferHTTPS shouldn't upgrade a URL with a port, got %s", got)
+	}
+}
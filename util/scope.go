@@ -0,0 +1,217 @@
+package util
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+/*
+Scope decides which links a crawl is allowed to follow. Anything InScope
+returns false for is dropped before it reaches the sitemap.
+*/
+type Scope interface {
+	InScope(link *url.URL) bool
+}
+
+/*
+FilterLinks removes any links from a list that are not in scope. It's
+FilterLinksByHostname for any Scope.
+*/
+func FilterLinks(links []*url.URL, scope Scope) []*url.URL {
+	var acceptableLinks []*url.URL
+	for i := 0; i < len(links); i++ {
+		if scope.InScope(links[i]) {
+			acceptableLinks = append(acceptableLinks, links[i])
+		}
+	}
+	return acceptableLinks
+}
+
+/*
+SameSiteScope accepts links with the same SiteKey as the root: the same
+registrable domain and all its subdomains, or for hosts like localhost, the
+exact same host. This is the default scope.
+*/
+type SameSiteScope struct {
+	Key string
+}
+
+/*
+NewSameSiteScope returns a SameSiteScope for the site root belongs to.
+*/
+func NewSameSiteScope(root *url.URL) (SameSiteScope, error) {
+	key, err := SiteKey(root)
+	if err != nil {
+		return SameSiteScope{}, err
+	}
+	return SameSiteScope{Key: key}, nil
+}
+
+/*
+InScope returns whether link is part of the same site.
+*/
+func (s SameSiteScope) InScope(link *url.URL) bool {
+	return LinkPartOfSite(link, s.Key)
+}
+
+/*
+ExactHostScope accepts links to one host (and port) only. Subdomains are left
+out.
+*/
+type ExactHostScope struct {
+	Host string
+}
+
+/*
+NewExactHostScope returns an ExactHostScope for root's host.
+*/
+func NewExactHostScope(root *url.URL) ExactHostScope {
+	return ExactHostScope{Host: strings.ToLower(root.Host)}
+}
+
+/*
+InScope returns whether link is on exactly the right host.
+*/
+func (s ExactHostScope) InScope(link *url.URL) bool {
+	return strings.ToLower(link.Host) == s.Host
+}
+
+/*
+SubdomainScope accepts links to Host itself, plus the listed subdomains of it.
+With Host kn100.me and Subdomains [blog], kn100.me and blog.kn100.me are in
+scope, but hire.kn100.me isn't.
+*/
+type SubdomainScope struct {
+	Host       string
+	Subdomains []string
+}
+
+/*
+InScope returns whether link is on Host or one of the listed subdomains.
+*/
+func (s SubdomainScope) InScope(link *url.URL) bool {
+	hostname := strings.ToLower(link.Hostname())
+	host := strings.ToLower(s.Host)
+	if hostname == host {
+		return true
+	}
+	for _, subdomain := range s.Subdomains {
+		if hostname == strings.ToLower(subdomain)+"."+host {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+AllowlistScope accepts links to any of Domains, or any subdomain of them.
+*/
+type AllowlistScope struct {
+	Domains []string
+}
+
+/*
+InScope returns whether link is on one of the allowed domains.
+*/
+func (s AllowlistScope) InScope(link *url.URL) bool {
+	hostname := strings.ToLower(link.Hostname())
+	for _, domain := range s.Domains {
+		domain = strings.ToLower(domain)
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+PathPrefixScope accepts links whose path starts with Prefix, whatever host
+they're on, so it's normally combined with another scope using AllScopes.
+*/
+type PathPrefixScope struct {
+	Prefix string
+}
+
+/*
+InScope returns whether link's path starts with the prefix.
+*/
+func (s PathPrefixScope) InScope(link *url.URL) bool {
+	path := link.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.HasPrefix(path, s.Prefix)
+}
+
+/*
+RegexScope matches the whole URL against regular expressions. A link is in
+scope if it matches at least one Include (or there aren't any), and doesn't
+match any Exclude.
+*/
+type RegexScope struct {
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+}
+
+/*
+NewRegexScope compiles the include and exclude patterns into a RegexScope.
+*/
+func NewRegexScope(include []string, exclude []string) (RegexScope, error) {
+	var scope RegexScope
+	for _, pattern := range include {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return scope, fmt.Errorf("bad include pattern %q: %w", pattern, err)
+		}
+		scope.Include = append(scope.Include, re)
+	}
+	for _, pattern := range exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return scope, fmt.Errorf("bad exclude pattern %q: %w", pattern, err)
+		}
+		scope.Exclude = append(scope.Exclude, re)
+	}
+	return scope, nil
+}
+
+/*
+InScope returns whether link passes the include and exclude rules.
+*/
+func (s RegexScope) InScope(link *url.URL) bool {
+	raw := link.String()
+	for _, re := range s.Exclude {
+		if re.MatchString(raw) {
+			return false
+		}
+	}
+	if len(s.Include) == 0 {
+		return true
+	}
+	for _, re := range s.Include {
+		if re.MatchString(raw) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+AllScopes is in scope only when every one of its scopes is, so scopes can be
+stacked: the same host, but only under /docs/, and never a PDF.
+*/
+type AllScopes []Scope
+
+/*
+InScope returns whether every scope accepts link.
+*/
+func (s AllScopes) InScope(link *url.URL) bool {
+	for _, scope := range s {
+		if !scope.InScope(link) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"net/url"
+	"testing"
+)
+
+/*
+checkScope asserts which of a list of URLs scope accepts.
+*/
+func checkScope(t *testing.T, scope Scope, cases map[string]bool) {
+	for raw, expected := range cases {
+		link, _ := url.Parse(raw)
+		if scope.InScope(link) != expected {
+			t.Errorf("%T.InScope(%s) should have been %t", scope, raw, expected)
+		}
+	}
+}
+
+func TestSameSiteScope(t *testing.T) {
+	root, _ := url.Parse("https://kn100.me/")
+	scope, err := NewSameSiteScope(root)
+	if err != nil {
+		t.Fatalf("No error should have occured. Err: %s", err)
+	}
+	checkScope(t, scope, map[string]bool{
+		"https://kn100.me/about":  true,
+		"https://hire.kn100.me/":  true,
+		"https://monzo.com/":      false,
+		"http://localhost:8080/a": false,
+	})
+}
+
+func TestExactHostScope(t *testing.T) {
+	root, _ := url.Parse("https://kn100.me/")
+	checkScope(t, NewExactHostScope(root), map[string]bool{
+		"https://kn100.me/about":  true,
+		"https://KN100.ME/about":  true,
+		"https://hire.kn100.me/":  false,
+		"https://kn100.me:8443/x": false,
+	})
+}
+
+func TestSubdomainScope(t *testing.T) {
+	checkScope(t, SubdomainScope{Host: "kn100.me", Subdomains: []string{"blog", "docs"}}, map[string]bool{
+		"https://kn100.me/":          true,
+		"https://blog.kn100.me/post": true,
+		"https://docs.kn100.me/":     true,
+		"https://hire.kn100.me/":     false,
+		"https://x.blog.kn100.me/":   false,
+	})
+}
+
+func TestAllowlistScope(t *testing.T) {
+	checkScope(t, AllowlistScope{Domains: []string{"kn100.me", "monzo.com"}}, map[string]bool{
+		"https://kn100.me/":         true,
+		"https://hire.kn100.me/":    true,
+		"https://monzo.com/about":   true,
+		"https://notkn100.me/":      false,
+		"https://kn100.me.evil.io/": false,
+	})
+}
+
+func TestPathPrefixScope(t *testing.T) {
+	checkScope(t, PathPrefixScope{Prefix: "/docs/"}, map[string]bool{
+		"https://kn100.me/docs/":        true,
+		"https://kn100.me/docs/a/b":     true,
+		"https://kn100.me/documents/":   false,
+		"https://kn100.me":              false,
+		"https://kn100.me/blog/docs/x/": false,
+	})
+}
+
+func TestRegexScope(t *testing.T) {
+	scope, err := NewRegexScope([]string{`/blog/`, `/docs/`}, []string{`\.pdf$`})
+	if err != nil {
+		t.Fatalf("No error should have occured. Err: %s", err)
+	}
+	checkScope(t, scope, map[string]bool{
+		"https://kn100.me/blog/post":  true,
+		"https://kn100.me/docs/intro": true,
+		"https://kn100.me/docs/a.pdf": false,
+		"https://kn100.me/about":      false,
+	})
+	if _, err := NewRegexScope([]string{"("}, nil); err == nil {
+		t.Errorf("An invalid pattern should have caused an error")
+	}
+}
+
+func TestAllScopes(t *testing.T) {
+	root, _ := url.Parse("https://kn100.me/")
+	scope := AllScopes{NewExactHostScope(root), PathPrefixScope{Prefix: "/docs/"}}
+	checkScope(t, scope, map[string]bool{
+		"https://kn100.me/docs/a":     true,
+		"https://kn100.me/blog/a":     false,
+		"https://hire.kn100.me/docs/": false,
+	})
+}
+
+func TestFilterLinks(t *testing.T) {
+	inScope, _ := url.Parse("https://kn100.me/docs/a")
+	outOfScope, _ := url.Parse("https://kn100.me/blog/a")
+	filtered := FilterLinks([]*url.URL{inScope, outOfScope}, PathPrefixScope{Prefix: "/docs/"})
+	if len(filtered) != 1 || filtered[0] != inScope {
+		t.Errorf("Expected only %s to be left, got %v", inScope, filtered)
+	}
+}
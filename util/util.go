@@ -4,7 +4,9 @@ package util
 
 import (
 	"fmt"
+	"net"
 	"net/url"
+	"strings"
 
 	"golang.org/x/net/publicsuffix"
 )
@@ -39,22 +41,62 @@ func CleanURLS(links []*url.URL) {
 
 /*
 LinkPartOfSite checks whether a given link exists under the domain of a site. It
-returns true if so, false if not. It makes use of the publicsuffix library for
-this, which is a database of tlds. It's possible this could be out of date if
-you're having trouble here.
+returns true if so, false if not. rootTLDPlusOne should come from SiteKey, so
+this works for localhost and friends too. Links we can't find a site for, like
+mailto: links, aren't part of any site.
 */
 func LinkPartOfSite(link *url.URL, rootTLDPlusOne string) bool {
-	// This allows us to crawl subdomains too!
-	linkTLDPlusOne, err := publicsuffix.EffectiveTLDPlusOne(link.Hostname())
+	linkTLDPlusOne, err := SiteKey(link)
 	if err != nil {
-		fmt.Printf("I couldn't extract the TLD Plus One of %s. This won't be included in the sitemap.\n", link.String())
 		return false
 	}
 	return rootTLDPlusOne == linkTLDPlusOne
 }
 
 /*
-CleanURL will remove anchors and query parameters from the passed link
+SiteKey returns what identifies the site a link belongs to. Normally that's the
+effective TLD plus one (kn100.me for blog.kn100.me), which lets us crawl
+subdomains too! It makes use of the publicsuffix library for this, which is a
+database of tlds. It's possible this could be out of date if you're having
+trouble here.
+Hosts with no public suffix - localhost, IP addresses, single label intranet
+names and the like - don't have a TLD plus one, so for those the key is the
+exact host, port included. localhost:8080 and localhost:8081 are different
+sites.
+*/
+func SiteKey(link *url.URL) (string, error) {
+	hostname := strings.ToLower(link.Hostname())
+	if hostname == "" {
+		return "", fmt.Errorf("%s has no host", link.String())
+	}
+	if !hasPublicSuffix(hostname) {
+		return strings.ToLower(link.Host), nil
+	}
+	tldPlusOne, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	if err != nil {
+		// The host is a public suffix itself (co.uk, say), so there's nothing
+		// to share with subdomains.
+		return strings.ToLower(link.Host), nil
+	}
+	return tldPlusOne, nil
+}
+
+/*
+hasPublicSuffix returns whether hostname ends in something on the public
+suffix list. The library makes up a suffix for names it doesn't know about,
+but tells us it did by saying it isn't an ICANN suffix without any dots in it.
+*/
+func hasPublicSuffix(hostname string) bool {
+	if net.ParseIP(hostname) != nil {
+		return false
+	}
+	suffix, icann := publicsuffix.PublicSuffix(hostname)
+	return icann || strings.Contains(suffix, ".")
+}
+
+/*
+CleanURL will remove anchors and query parameters from the passed link. The
+crawler uses a Normalizer now, which can keep the query string.
 */
 func CleanURL(link *url.URL) {
 	link.Fragment = ""
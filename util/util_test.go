@@ -50,3 +50,35 @@ func TestInvalidDataLinkPartOfSite(t *testing.T) {
 		t.Errorf("Invalid domain %s should NOT be considered part of the site.", badURL.String())
 	}
 }
+
+func TestSiteKey(t *testing.T) {
+	cases := map[string]string{
+		"https://blog.kn100.me/post":     "kn100.me",
+		"https://KN100.me/":              "kn100.me",
+		"http://localhost:8080/":         "localhost:8080",
+		"http://localhost/":              "localhost",
+		"http://127.0.0.1:41234/about":   "127.0.0.1:41234",
+		"http://[::1]:8080/":             "[::1]:8080",
+		"http://intranet/wiki":           "intranet",
+		"http://staging.internal:3000/x": "staging.internal:3000",
+		"https://co.uk/":                 "co.uk",
+	}
+	for raw, expected := range cases {
+		link, _ := url.Parse(raw)
+		actual, err := SiteKey(link)
+		if err != nil || actual != expected {
+			t.Errorf("SiteKey(%s) should have been %s, got %s (err %v)", raw, expected, actual, err)
+		}
+	}
+}
+
+func TestLinkPartOfSiteExactHost(t *testing.T) {
+	samePort, _ := url.Parse("http://localhost:8080/about")
+	otherPort, _ := url.Parse("http://localhost:8081/about")
+	if LinkPartOfSite(samePort, "localhost:8080") != true {
+		t.Errorf("URL %s is part of %s", samePort.String(), "localhost:8080")
+	}
+	if LinkPartOfSite(otherPort, "localhost:8080") != false {
+		t.Errorf("URL %s is NOT part of %s", otherPort.String(), "localhost:8080")
+	}
+}